@@ -2,27 +2,64 @@ package main
 
 import (
 	"context"
+	"errors"
 	"fmt"
+	"log/slog"
+	"net/http"
 	"os"
+	"os/signal"
 	"strconv"
 	"strings"
+	"sync"
+	"syscall"
+	"time"
 
 	"github.com/docker/docker/client"
+	"github.com/google/uuid"
 	"github.com/minio/minio-go/v7"
 	"github.com/minio/minio-go/v7/pkg/credentials"
 	"github.com/redis/go-redis/v9"
+	"github.com/t3m8ch/coderunner/internal/api"
 	"github.com/t3m8ch/coderunner/internal/filesctl"
 	"github.com/t3m8ch/coderunner/internal/handler"
+	"github.com/t3m8ch/coderunner/internal/logging"
 	"github.com/t3m8ch/coderunner/internal/model"
 	"github.com/t3m8ch/coderunner/internal/sandbox"
+	"github.com/t3m8ch/coderunner/internal/taskstore"
+	"github.com/t3m8ch/coderunner/internal/tracing"
+	"go.opentelemetry.io/contrib/instrumentation/net/http/otelhttp"
 )
 
+// Time given to running tasks to finish after they were interrupted by the
+// shutdown deadline.
+const interruptGracePeriod = 10 * time.Second
+
 func main() {
-	ctx := context.Background()
+	logger, err := logging.New(os.Stderr, os.Getenv("LOG_LEVEL"), os.Getenv("LOG_FORMAT"))
+	if err != nil {
+		panic(err)
+	}
+	slog.SetDefault(logger)
+	ctx := logging.WithLogger(context.Background(), logger)
+
+	shutdownTracing, err := tracing.Setup(ctx, "coderunner")
+	if err != nil {
+		panic(fmt.Errorf("tracing: %w", err))
+	}
+
+	// intakeCtx is cancelled by SIGINT/SIGTERM and only stops accepting new
+	// tasks, the accepted ones are drained using ctx.
+	intakeCtx, stopIntake := signal.NotifyContext(ctx, os.Interrupt, syscall.SIGTERM)
+	defer stopIntake()
+
+	runnerID := getRunnerID()
+	logger.Info("Runner started", "runner_id", runnerID)
 
 	redisClient := getRedisClient()
 	defer redisClient.Close()
 
+	go handler.KeepInstanceAlive(ctx, redisClient, runnerID)
+
 	minioClient := getMinioClient()
 
 	dockerClient, err := client.NewClientWithOpts(
@@ -33,42 +70,260 @@ func main() {
 		panic(err)
 	}
 
-	var sandboxManager sandbox.Manager
-	if strings.ToLower(os.Getenv("USE_TMPFS")) == "true" {
-		fmt.Println("Using tmpfs")
-		sandboxManager = sandbox.NewTMPFSDockerManager(dockerClient)
+	security := sandbox.DefaultSecurityConfig
+	if path := os.Getenv("SANDBOX_SECURITY_CONFIG"); path != "" {
+		security, err = sandbox.LoadSecurityConfig(path)
+		if err != nil {
+			panic(fmt.Errorf("SANDBOX_SECURITY_CONFIG: %w", err))
+		}
+	}
+
+	sandboxMaxAge := getEnvDuration("SANDBOX_MAX_AGE", 30*time.Minute)
+
+	var dockerManager sandbox.Manager
+	var sandboxPool *sandbox.PoolManager
+	if poolSize := getEnvInt("SANDBOX_POOL_SIZE", 0); poolSize > 0 {
+		logger.Info("Using a sandbox pool", "size", poolSize)
+		sandboxPool = sandbox.NewPoolManager(dockerClient, runnerID, security, sandbox.PoolConfig{
+			Size:    poolSize,
+			MaxUses: getEnvInt("SANDBOX_POOL_MAX_USES", 100),
+			// Leased containers are replaced well before the reaper would
+			// take them for orphans. Idle ones are only checked when taken,
+			// one reaped meanwhile is replaced then.
+			MaxAge: sandboxMaxAge / 2,
+		})
+		dockerManager = sandboxPool
+	} else if strings.ToLower(os.Getenv("USE_TMPFS")) == "true" {
+		logger.Info("Using tmpfs")
+		dockerManager = sandbox.NewTMPFSDockerManager(dockerClient, runnerID, security)
 	} else {
-		sandboxManager = sandbox.NewDockerManager(dockerClient)
+		dockerManager = sandbox.NewDockerManager(dockerClient, runnerID, security)
+	}
+
+	singleSandboxTests := strings.ToLower(os.Getenv("SINGLE_SANDBOX_TESTS")) == "true"
+	if singleSandboxTests && sandboxPool == nil && strings.ToLower(os.Getenv("USE_TMPFS")) != "true" {
+		// Only sandboxes running as execs can be restarted.
+		logger.Warn("SINGLE_SANDBOX_TESTS needs USE_TMPFS or SANDBOX_POOL_SIZE, running every test in its own sandbox")
+		singleSandboxTests = false
+	}
+	sandboxManager := sandbox.NewTrackingDecorator(sandbox.NewTracingDecorator(sandbox.NewMetricsDecorator(dockerManager)))
+
+	reaper := sandbox.NewReaper(
+		dockerClient,
+		runnerID,
+		sandboxMaxAge,
+		handler.InstanceChecker(redisClient),
+	)
+	removed, err := reaper.Sweep(ctx)
+	if err != nil {
+		logger.Error("Error reaping sandboxes", "error", err)
+	}
+	if removed > 0 {
+		logger.Info("Reaped orphaned sandboxes", "count", removed)
+	}
+	go reaper.Run(ctx, getEnvDuration("SANDBOX_REAP_INTERVAL", time.Minute))
+
+	if images := os.Getenv("SANDBOX_POOL_IMAGES"); sandboxPool != nil && images != "" {
+		go func() {
+			err := sandboxPool.Warm(ctx, strings.Split(images, ",")...)
+			if err != nil {
+				logger.Error("Error warming sandbox pool", "error", err)
+			}
+		}()
 	}
 
-	filesManager := filesctl.NewMinioManager(minioClient)
+	filesManager := filesctl.NewTracingDecorator(filesctl.NewMinioManager(minioClient))
+	taskStore := taskstore.NewRedisStore(redisClient, getEnvDuration("TASK_TTL", 0))
+	cancellations := handler.NewCancellations(ctx)
 
 	tasksToCompile := make(chan model.Task, 30)
 	tasksToTest := make(chan model.Task, 2)
+	handler.RegisterQueueMetrics(tasksToCompile, tasksToTest)
+
+	httpAddr := os.Getenv("HTTP_ADDR")
+	if httpAddr == "" {
+		httpAddr = ":8080"
+	}
+	// Requests continue the trace of the caller, the tasks submitted with
+	// them are traced as part of it. Scrapes aren't worth tracing.
+	apiHandler := otelhttp.NewHandler(
+		api.NewServer(filesManager, taskStore, redisClient, cancellations, tasksToCompile).Handler(),
+		"api",
+		otelhttp.WithFilter(func(r *http.Request) bool { return r.URL.Path != "/metrics" }),
+	)
+	httpServer := &http.Server{
+		Addr:    httpAddr,
+		Handler: apiHandler,
+	}
+	go func() {
+		logger.Info("HTTP API listening", "addr", httpAddr)
+		err := httpServer.ListenAndServe()
+		if err != nil && !errors.Is(err, http.ErrServerClosed) {
+			panic(err)
+		}
+	}()
+
+	go handler.HandleCancelTaskCommands(ctx, redisClient, cancellations)
 
-	fmt.Println("RUN!")
+	logger.Info("Runner is ready")
 
+	var compileWorkers sync.WaitGroup
 	for range 5 {
-		go handler.HandleTasksToCompile(
-			ctx,
-			filesManager,
-			sandboxManager,
-			tasksToCompile,
-			tasksToTest,
-		)
+		compileWorkers.Add(1)
+		go func() {
+			defer compileWorkers.Done()
+			handler.HandleTasksToCompile(
+				ctx,
+				filesManager,
+				sandboxManager,
+				tasksToCompile,
+				tasksToTest,
+				redisClient,
+				taskStore,
+				cancellations,
+				getEnvInt("COMPILER_OUTPUT_LIMIT", 64<<10),
+			)
+		}()
 	}
 
+	var testWorkers sync.WaitGroup
 	for range 3 {
-		go handler.HandleTasksToTest(
-			ctx,
-			filesManager,
-			sandboxManager,
-			tasksToTest,
+		testWorkers.Add(1)
+		go func() {
+			defer testWorkers.Done()
+			handler.HandleTasksToTest(
+				ctx,
+				filesManager,
+				sandboxManager,
+				tasksToTest,
+				redisClient,
+				taskStore,
+				cancellations,
+				singleSandboxTests,
+			)
+		}()
+	}
+
+	// Compile workers are the only senders to tasksToTest.
+	go func() {
+		compileWorkers.Wait()
+		close(tasksToTest)
+	}()
+
+	rejudgeDone := make(chan struct{})
+	go func() {
+		defer close(rejudgeDone)
+		handler.HandleRejudgeTaskCommands(intakeCtx, redisClient, taskStore, cancellations, tasksToCompile)
+	}()
+
+	switch intake := os.Getenv("TASK_INTAKE"); intake {
+	case "", "pubsub":
+		handler.HandleStartTaskCommands(intakeCtx, redisClient, taskStore, cancellations, tasksToCompile)
+	case "stream":
+		handler.HandleStartTaskStream(
+			intakeCtx,
 			redisClient,
+			taskStore,
+			cancellations,
+			tasksToCompile,
+			runnerID,
+			getEnvDuration("STREAM_CLAIM_IDLE", time.Minute),
 		)
+	default:
+		panic(fmt.Errorf("unknown TASK_INTAKE %q", intake))
+	}
+	// Intake has stopped, a second signal kills the runner if draining gets
+	// stuck.
+	stopIntake()
+
+	// Rejudged tasks are queued to tasksToCompile as well.
+	<-rejudgeDone
+	shutdown(ctx, httpServer, cancellations, sandboxManager, sandboxPool, tasksToCompile, &testWorkers)
+
+	flushCtx, cancel := context.WithTimeout(ctx, 5*time.Second)
+	defer cancel()
+	err = shutdownTracing(flushCtx)
+	if err != nil {
+		logger.Error("Error flushing traces", "error", err)
 	}
+}
+
+func shutdown(
+	ctx context.Context,
+	httpServer *http.Server,
+	cancellations *handler.Cancellations,
+	sandboxManager *sandbox.TrackingDecorator,
+	sandboxPool *sandbox.PoolManager,
+	tasksToCompile chan model.Task,
+	testWorkers *sync.WaitGroup,
+) {
+	timeout := getEnvDuration("SHUTDOWN_TIMEOUT", 30*time.Second)
+	logger := logging.FromContext(ctx)
+	logger.Info("Shutting down, waiting for running tasks", "timeout", timeout)
+
+	shutdownCtx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	workersDone := make(chan struct{})
+	go func() {
+		testWorkers.Wait()
+		close(workersDone)
+	}()
+
+	// The HTTP API submits tasks too, so it must be stopped before closing
+	// the queue. If it doesn't stop in time, the queue stays open and the
+	// workers are abandoned once the deadline passes.
+	err := httpServer.Shutdown(shutdownCtx)
+	if err != nil {
+		logger.Error("Error shutting down HTTP server", "error", err)
+	} else {
+		close(tasksToCompile)
+	}
+
+	select {
+	case <-workersDone:
+	case <-shutdownCtx.Done():
+		logger.Warn("Shutdown deadline exceeded, interrupting running tasks")
+		cancellations.Shutdown()
+
+		select {
+		case <-workersDone:
+		case <-time.After(interruptGracePeriod):
+			logger.Warn("Workers did not stop in time")
+		}
+	}
+
+	removed, err := sandboxManager.RemoveAll(ctx)
+	if err != nil {
+		logger.Error("Error removing leftover sandboxes", "error", err)
+	}
+	if removed > 0 {
+		logger.Info("Removed leftover sandboxes", "count", removed)
+	}
+
+	if sandboxPool != nil {
+		err = sandboxPool.Close(ctx)
+		if err != nil {
+			logger.Error("Error removing pooled containers", "error", err)
+		}
+	}
+
+	logger.Info("Shutdown complete")
+}
 
-	handler.HandleStartTaskCommands(ctx, redisClient, tasksToCompile)
+func getRunnerID() string {
+	if runnerID := os.Getenv("RUNNER_ID"); runnerID != "" {
+		return runnerID
+	}
+
+	hostname, err := os.Hostname()
+	if err != nil {
+		hostname = "coderunner"
+	}
+
+	// A fresh suffix on every start keeps a restarted runner from treating
+	// the unfinished tasks of its previous incarnation as its own.
+	return fmt.Sprintf("%s-%s", hostname, uuid.NewString()[:8])
 }
 
 func getRedisClient() *redis.Client {
@@ -103,3 +358,31 @@ func getMinioClient() *minio.Client {
 
 	return client
 }
+
+func getEnvInt(name string, defaultValue int) int {
+	value := os.Getenv(name)
+	if value == "" {
+		return defaultValue
+	}
+
+	result, err := strconv.Atoi(value)
+	if err != nil {
+		panic(fmt.Errorf("%s: %w", name, err))
+	}
+
+	return result
+}
+
+func getEnvDuration(name string, defaultValue time.Duration) time.Duration {
+	value := os.Getenv(name)
+	if value == "" {
+		return defaultValue
+	}
+
+	result, err := time.ParseDuration(value)
+	if err != nil {
+		panic(fmt.Errorf("%s: %w", name, err))
+	}
+
+	return result
+}
@@ -0,0 +1,306 @@
+package api
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"strconv"
+
+	"github.com/google/uuid"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"github.com/redis/go-redis/v9"
+	"github.com/t3m8ch/coderunner/internal/filesctl"
+	"github.com/t3m8ch/coderunner/internal/handler"
+	"github.com/t3m8ch/coderunner/internal/model"
+	"github.com/t3m8ch/coderunner/internal/taskstore"
+)
+
+const (
+	codeBucketName   = "code"
+	testsBucketName  = "tests"
+	defaultListLimit = 50
+	maxListLimit     = 1000
+	maxRequestBody   = 64 << 20
+)
+
+type Server struct {
+	filesManager   filesctl.Manager
+	taskStore      taskstore.Store
+	redisClient    *redis.Client
+	cancellations  *handler.Cancellations
+	tasksToCompile chan model.Task
+}
+
+func NewServer(
+	filesManager filesctl.Manager,
+	taskStore taskstore.Store,
+	redisClient *redis.Client,
+	cancellations *handler.Cancellations,
+	tasksToCompile chan model.Task,
+) *Server {
+	return &Server{
+		filesManager:   filesManager,
+		taskStore:      taskStore,
+		redisClient:    redisClient,
+		cancellations:  cancellations,
+		tasksToCompile: tasksToCompile,
+	}
+}
+
+func (s *Server) Handler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("POST /tasks", s.submitTask)
+	mux.HandleFunc("GET /tasks", s.listTasks)
+	mux.HandleFunc("GET /tasks/{id}", s.getTask)
+	mux.HandleFunc("POST /tasks/{id}/cancel", s.cancelTask)
+	mux.HandleFunc("POST /tasks/{id}/rejudge", s.rejudgeTask)
+	mux.HandleFunc("POST /rejudge", s.rejudgeTasks)
+	mux.Handle("GET /metrics", promhttp.Handler())
+	return mux
+}
+
+// submitTaskRequest accepts code and tests either inline or as locations of
+// already uploaded objects. Inline tests use the same format as tests files.
+type submitTaskRequest struct {
+	ID            string              `json:"id"`
+	Compiler      string              `json:"compiler"`
+	Code          *string             `json:"code"`
+	CodeLocation  *model.FileLocation `json:"codeLocation"`
+	Tests         json.RawMessage     `json:"tests"`
+	TestsLocation *model.FileLocation `json:"testsLocation"`
+}
+
+func (s *Server) submitTask(w http.ResponseWriter, r *http.Request) {
+	var req submitTaskRequest
+	err := json.NewDecoder(http.MaxBytesReader(w, r.Body, maxRequestBody)).Decode(&req)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, fmt.Errorf("invalid request body: %w", err))
+		return
+	}
+
+	if req.Compiler == "" {
+		writeError(w, http.StatusBadRequest, errors.New("compiler is required"))
+		return
+	}
+	if (req.Code == nil) == (req.CodeLocation == nil) {
+		writeError(w, http.StatusBadRequest, errors.New("exactly one of code and codeLocation is required"))
+		return
+	}
+	if (req.Tests == nil) == (req.TestsLocation == nil) {
+		writeError(w, http.StatusBadRequest, errors.New("exactly one of tests and testsLocation is required"))
+		return
+	}
+	if req.Tests != nil {
+		if _, err := model.ParseTestsJSON(req.Tests); err != nil {
+			writeError(w, http.StatusBadRequest, fmt.Errorf("invalid tests: %w", err))
+			return
+		}
+	}
+
+	if req.ID == "" {
+		req.ID = uuid.NewString()
+	}
+	// Requests with the same ID may race until one of them creates the task,
+	// so they must not overwrite each other's files.
+	objectName := req.ID + "-" + uuid.NewString()
+
+	taskCommand := model.StartTaskCommand{
+		ID:       req.ID,
+		Compiler: req.Compiler,
+	}
+
+	if req.Code != nil {
+		taskCommand.CodeLocation = model.FileLocation{BucketName: codeBucketName, ObjectName: objectName}
+		err = s.putFile(r.Context(), taskCommand.CodeLocation, []byte(*req.Code))
+		if err != nil {
+			writeError(w, http.StatusInternalServerError, fmt.Errorf("uploading code: %w", err))
+			return
+		}
+	} else {
+		taskCommand.CodeLocation = *req.CodeLocation
+	}
+
+	if req.Tests != nil {
+		taskCommand.TestsLocation = model.FileLocation{BucketName: testsBucketName, ObjectName: objectName + ".json"}
+		err = s.putFile(r.Context(), taskCommand.TestsLocation, req.Tests)
+		if err != nil {
+			writeError(w, http.StatusInternalServerError, fmt.Errorf("uploading tests: %w", err))
+			return
+		}
+	} else {
+		taskCommand.TestsLocation = *req.TestsLocation
+	}
+
+	// The task outlives the request, so it must not be tied to its context.
+	task, err := handler.SubmitTask(
+		context.WithoutCancel(r.Context()),
+		s.redisClient,
+		s.taskStore,
+		s.cancellations,
+		taskCommand,
+		s.tasksToCompile,
+	)
+	if errors.Is(err, taskstore.ErrExists) {
+		writeError(w, http.StatusConflict, fmt.Errorf("task %s already exists", req.ID))
+		return
+	}
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	writeJSON(w, http.StatusAccepted, task)
+}
+
+func (s *Server) getTask(w http.ResponseWriter, r *http.Request) {
+	task, err := s.taskStore.Get(r.Context(), r.PathValue("id"))
+	if errors.Is(err, taskstore.ErrNotFound) {
+		writeError(w, http.StatusNotFound, err)
+		return
+	}
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+
+	writeJSON(w, http.StatusOK, task)
+}
+
+func (s *Server) cancelTask(w http.ResponseWriter, r *http.Request) {
+	task, err := s.taskStore.Get(r.Context(), r.PathValue("id"))
+	if errors.Is(err, taskstore.ErrNotFound) {
+		writeError(w, http.StatusNotFound, err)
+		return
+	}
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	if task.Finished() {
+		writeError(w, http.StatusConflict, fmt.Errorf("task %s is already %s", task.ID, task.State))
+		return
+	}
+
+	err = handler.CancelTask(r.Context(), s.redisClient, task.ID)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+
+	writeJSON(w, http.StatusAccepted, task)
+}
+
+func (s *Server) rejudgeTask(w http.ResponseWriter, r *http.Request) {
+	task, err := s.taskStore.Get(r.Context(), r.PathValue("id"))
+	if errors.Is(err, taskstore.ErrNotFound) {
+		writeError(w, http.StatusNotFound, err)
+		return
+	}
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	if !task.Finished() {
+		writeError(w, http.StatusConflict, fmt.Errorf("task %s is still %s", task.ID, task.State))
+		return
+	}
+
+	tasks, err := s.rejudge(r, model.RejudgeTaskCommand{ID: task.ID})
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	if len(tasks) == 0 {
+		writeError(w, http.StatusConflict, fmt.Errorf("task %s is already being rejudged", task.ID))
+		return
+	}
+
+	writeJSON(w, http.StatusAccepted, tasks[0])
+}
+
+// rejudgeTasks accepts a RejudgeTaskCommand and responds with the tasks that
+// were queued, running tasks are skipped. If some tasks couldn't be queued,
+// the error comes with the IDs of those that were.
+func (s *Server) rejudgeTasks(w http.ResponseWriter, r *http.Request) {
+	var command model.RejudgeTaskCommand
+	err := json.NewDecoder(http.MaxBytesReader(w, r.Body, maxRequestBody)).Decode(&command)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, fmt.Errorf("invalid request body: %w", err))
+		return
+	}
+	if command.ID == "" && len(command.IDs) == 0 && command.TestsLocation == nil {
+		writeError(w, http.StatusBadRequest, errors.New("one of id, ids and testsLocation is required"))
+		return
+	}
+
+	tasks, err := s.rejudge(r, command)
+	if errors.Is(err, taskstore.ErrNotFound) {
+		writeError(w, http.StatusNotFound, err)
+		return
+	}
+	if err != nil {
+		// Some tasks may have been queued before others failed.
+		queued := make([]string, 0, len(tasks))
+		for _, task := range tasks {
+			queued = append(queued, task.ID)
+		}
+		writeJSON(w, http.StatusInternalServerError, map[string]any{
+			"error":  err.Error(),
+			"queued": queued,
+		})
+		return
+	}
+
+	writeJSON(w, http.StatusAccepted, tasks)
+}
+
+func (s *Server) rejudge(r *http.Request, command model.RejudgeTaskCommand) ([]model.Task, error) {
+	// The tasks outlive the request, so they must not be tied to its context.
+	return handler.RejudgeTasks(
+		context.WithoutCancel(r.Context()),
+		s.redisClient,
+		s.taskStore,
+		s.cancellations,
+		command,
+		s.tasksToCompile,
+	)
+}
+
+func (s *Server) listTasks(w http.ResponseWriter, r *http.Request) {
+	limit := defaultListLimit
+	if value := r.URL.Query().Get("limit"); value != "" {
+		parsed, err := strconv.Atoi(value)
+		if err != nil || parsed <= 0 {
+			writeError(w, http.StatusBadRequest, fmt.Errorf("invalid limit %q", value))
+			return
+		}
+		limit = min(parsed, maxListLimit)
+	}
+
+	tasks, err := s.taskStore.List(r.Context(), limit)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+
+	writeJSON(w, http.StatusOK, tasks)
+}
+
+func (s *Server) putFile(ctx context.Context, location model.FileLocation, data []byte) error {
+	return s.filesManager.PutFile(ctx, location.BucketName, location.ObjectName, data)
+}
+
+func writeJSON(w http.ResponseWriter, status int, value any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	err := json.NewEncoder(w).Encode(value)
+	if err != nil {
+		slog.Error("Error writing response", "error", err)
+	}
+}
+
+func writeError(w http.ResponseWriter, status int, err error) {
+	writeJSON(w, status, map[string]string{"error": err.Error()})
+}
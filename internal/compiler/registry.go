@@ -0,0 +1,136 @@
+package compiler
+
+import (
+	"maps"
+	"slices"
+
+	"github.com/t3m8ch/coderunner/internal/sandbox"
+)
+
+// Spec describes how to build and run a submission written for a particular
+// toolchain. Paths in CompileCmd refer to the compile sandbox, paths in RunCmd
+// refer to the test sandbox, where the artifact is placed at ExecutablePath.
+type Spec struct {
+	CompileImage string
+	SourceFile   string
+	CompileCmd   []string
+	ArtifactPath string
+
+	RunImage       string
+	ExecutablePath string
+	RunCmd         []string
+}
+
+const (
+	workDir        = sandbox.WorkDir
+	artifactPath   = workDir + "/output"
+	executablePath = workDir + "/exec.out"
+
+	nativeRunImage = "debian:bookworm"
+	jvmRunImage    = "eclipse-temurin:21-jre"
+)
+
+var registry = map[string]Spec{
+	"c": {
+		CompileImage:   "gcc:latest",
+		SourceFile:     workDir + "/main.c",
+		CompileCmd:     []string{"gcc", "-std=c17", "-O2", workDir + "/main.c", "-o", artifactPath, "-static", "-lm"},
+		ArtifactPath:   artifactPath,
+		RunImage:       nativeRunImage,
+		ExecutablePath: executablePath,
+		RunCmd:         []string{executablePath},
+	},
+	"cpp17": {
+		CompileImage:   "gcc:latest",
+		SourceFile:     workDir + "/main.cpp",
+		CompileCmd:     []string{"g++", "-std=c++17", "-O2", workDir + "/main.cpp", "-o", artifactPath, "-static"},
+		ArtifactPath:   artifactPath,
+		RunImage:       nativeRunImage,
+		ExecutablePath: executablePath,
+		RunCmd:         []string{executablePath},
+	},
+	"cpp20": {
+		CompileImage:   "gcc:latest",
+		SourceFile:     workDir + "/main.cpp",
+		CompileCmd:     []string{"g++", "-std=c++20", "-O2", workDir + "/main.cpp", "-o", artifactPath, "-static"},
+		ArtifactPath:   artifactPath,
+		RunImage:       nativeRunImage,
+		ExecutablePath: executablePath,
+		RunCmd:         []string{executablePath},
+	},
+	"rust": {
+		CompileImage:   "rust:latest",
+		SourceFile:     workDir + "/main.rs",
+		CompileCmd:     []string{"rustc", "--edition", "2021", "-O", "-C", "target-feature=+crt-static", "-o", artifactPath, workDir + "/main.rs"},
+		ArtifactPath:   artifactPath,
+		RunImage:       nativeRunImage,
+		ExecutablePath: executablePath,
+		RunCmd:         []string{executablePath},
+	},
+	"go": {
+		CompileImage:   "golang:latest",
+		SourceFile:     workDir + "/main.go",
+		CompileCmd:     []string{"env", "CGO_ENABLED=0", "GOCACHE=/tmp/go-cache", "go", "build", "-o", artifactPath, workDir + "/main.go"},
+		ArtifactPath:   artifactPath,
+		RunImage:       nativeRunImage,
+		ExecutablePath: executablePath,
+		RunCmd:         []string{executablePath},
+	},
+	"java": {
+		CompileImage: "eclipse-temurin:21-jdk",
+		SourceFile:   workDir + "/Main.java",
+		CompileCmd: []string{
+			"sh", "-c",
+			"javac -d " + workDir + "/classes " + workDir + "/Main.java && jar --create --file " + artifactPath + " --main-class Main -C " + workDir + "/classes .",
+		},
+		ArtifactPath:   artifactPath,
+		RunImage:       jvmRunImage,
+		ExecutablePath: executablePath,
+		RunCmd:         []string{"java", "-jar", executablePath},
+	},
+	"kotlin": {
+		CompileImage:   "zenika/kotlin:latest",
+		SourceFile:     workDir + "/main.kt",
+		CompileCmd:     []string{"kotlinc", workDir + "/main.kt", "-include-runtime", "-d", artifactPath + ".jar"},
+		ArtifactPath:   artifactPath + ".jar",
+		RunImage:       jvmRunImage,
+		ExecutablePath: executablePath,
+		RunCmd:         []string{"java", "-jar", executablePath},
+	},
+	"python": {
+		CompileImage:   "python:3.12-slim",
+		SourceFile:     workDir + "/main.py",
+		CompileCmd:     []string{"python3", "-m", "py_compile", workDir + "/main.py"},
+		ArtifactPath:   workDir + "/main.py",
+		RunImage:       "python:3.12-slim",
+		ExecutablePath: executablePath,
+		RunCmd:         []string{"python3", executablePath},
+	},
+	"pascal": {
+		CompileImage:   "frolvlad/alpine-fpc:latest",
+		SourceFile:     workDir + "/main.pas",
+		CompileCmd:     []string{"fpc", "-O2", "-o" + artifactPath, workDir + "/main.pas"},
+		ArtifactPath:   artifactPath,
+		RunImage:       nativeRunImage,
+		ExecutablePath: executablePath,
+		RunCmd:         []string{executablePath},
+	},
+}
+
+func init() {
+	// Clients written before the registry existed send "g++" and expect the
+	// plain C++ toolchain.
+	registry["g++"] = registry["cpp17"]
+}
+
+// Lookup returns the spec registered under the given StartTaskCommand.Compiler
+// value.
+func Lookup(name string) (Spec, bool) {
+	spec, ok := registry[name]
+	return spec, ok
+}
+
+// Names returns all registered compiler names in sorted order.
+func Names() []string {
+	return slices.Sorted(maps.Keys(registry))
+}
@@ -7,4 +7,5 @@ import (
 type Manager interface {
 	PutFile(ctx context.Context, bucket string, name string, data []byte) error
 	LoadFile(ctx context.Context, bucket string, name string) ([]byte, error)
+	Exists(ctx context.Context, bucket string, name string) (bool, error)
 }
@@ -35,3 +35,14 @@ func (m *MinioManager) LoadFile(ctx context.Context, bucket string, name string)
 
 	return data, nil
 }
+
+func (m *MinioManager) Exists(ctx context.Context, bucket string, name string) (bool, error) {
+	_, err := m.client.StatObject(ctx, bucket, name, minio.StatObjectOptions{})
+	if err != nil {
+		if minio.ToErrorResponse(err).Code == "NoSuchKey" {
+			return false, nil
+		}
+		return false, err
+	}
+	return true, nil
+}
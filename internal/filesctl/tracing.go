@@ -0,0 +1,60 @@
+package filesctl
+
+import (
+	"context"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
+)
+
+var tracer = otel.Tracer("github.com/t3m8ch/coderunner/internal/filesctl")
+
+// TracingDecorator records a span for every call.
+type TracingDecorator struct {
+	manager Manager
+}
+
+func NewTracingDecorator(manager Manager) Manager {
+	return &TracingDecorator{manager: manager}
+}
+
+func startSpan(ctx context.Context, method string, bucket string, name string) (context.Context, trace.Span) {
+	return tracer.Start(ctx, "files."+method, trace.WithAttributes(
+		attribute.String("files.bucket", bucket),
+		attribute.String("files.object", name),
+	))
+}
+
+func endSpan(span trace.Span, err error) {
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	}
+	span.End()
+}
+
+func (d *TracingDecorator) PutFile(ctx context.Context, bucket string, name string, data []byte) error {
+	ctx, span := startSpan(ctx, "PutFile", bucket, name)
+	span.SetAttributes(attribute.Int("files.size", len(data)))
+	err := d.manager.PutFile(ctx, bucket, name, data)
+	endSpan(span, err)
+	return err
+}
+
+func (d *TracingDecorator) LoadFile(ctx context.Context, bucket string, name string) ([]byte, error) {
+	ctx, span := startSpan(ctx, "LoadFile", bucket, name)
+	data, err := d.manager.LoadFile(ctx, bucket, name)
+	span.SetAttributes(attribute.Int("files.size", len(data)))
+	endSpan(span, err)
+	return data, err
+}
+
+func (d *TracingDecorator) Exists(ctx context.Context, bucket string, name string) (bool, error) {
+	ctx, span := startSpan(ctx, "Exists", bucket, name)
+	exists, err := d.manager.Exists(ctx, bucket, name)
+	span.SetAttributes(attribute.Bool("files.exists", exists))
+	endSpan(span, err)
+	return exists, err
+}
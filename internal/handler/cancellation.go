@@ -0,0 +1,194 @@
+package handler
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+	"github.com/t3m8ch/coderunner/internal/logging"
+	"github.com/t3m8ch/coderunner/internal/model"
+	"github.com/t3m8ch/coderunner/internal/sandbox"
+	"github.com/t3m8ch/coderunner/internal/taskstore"
+	"go.opentelemetry.io/otel/trace"
+)
+
+const cancelMarkerTTL = 24 * time.Hour
+
+// ErrShuttingDown is the cancellation cause of tasks interrupted by runner
+// shutdown.
+var ErrShuttingDown = errors.New("runner is shutting down")
+
+// Cancellations keeps a context for every task this runner is working on, from
+// the moment it is queued until its result is published. The context carries
+// the span of the task, which ends when the task is released.
+type Cancellations struct {
+	ctx      context.Context
+	shutdown context.CancelCauseFunc
+
+	mu    sync.Mutex
+	tasks map[string]taskContext
+}
+
+type taskContext struct {
+	ctx    context.Context
+	cancel context.CancelFunc
+	span   trace.Span
+}
+
+// NewCancellations returns a registry whose task contexts derive from ctx.
+func NewCancellations(ctx context.Context) *Cancellations {
+	ctx, shutdown := context.WithCancelCause(ctx)
+	return &Cancellations{
+		ctx:      ctx,
+		shutdown: shutdown,
+		tasks:    make(map[string]taskContext),
+	}
+}
+
+// register takes over the span of ctx as the span of the task.
+func (c *Cancellations) register(ctx context.Context, taskID string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	span := trace.SpanFromContext(ctx)
+	taskCtx, cancel := context.WithCancel(trace.ContextWithSpan(c.ctx, span))
+	c.tasks[taskID] = taskContext{ctx: taskCtx, cancel: cancel, span: span}
+}
+
+// context returns the context of the given task, or ctx if the task isn't
+// registered. The task context doesn't derive from ctx, see contextForTask.
+func (c *Cancellations) context(ctx context.Context, taskID string) context.Context {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if task, ok := c.tasks[taskID]; ok {
+		return task.ctx
+	}
+	return ctx
+}
+
+// contextForTask returns the context of the given task, carrying the task ID
+// and the logger of ctx.
+func contextForTask(ctx context.Context, cancellations *Cancellations, taskID string) context.Context {
+	taskCtx := cancellations.context(ctx, taskID)
+	taskCtx = logging.WithLogger(taskCtx, logging.FromContext(ctx))
+	return sandbox.WithTaskID(taskCtx, taskID)
+}
+
+func (c *Cancellations) release(taskID string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if task, ok := c.tasks[taskID]; ok {
+		task.cancel()
+		task.span.End()
+		delete(c.tasks, taskID)
+	}
+}
+
+func (c *Cancellations) isCancelled(taskID string) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	task, ok := c.tasks[taskID]
+	return ok && task.ctx.Err() != nil
+}
+
+func (c *Cancellations) isInterrupted(taskID string) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	task, ok := c.tasks[taskID]
+	return ok && errors.Is(context.Cause(task.ctx), ErrShuttingDown)
+}
+
+// Cancel cancels the context of the given task and reports whether the task
+// is handled by this runner.
+func (c *Cancellations) Cancel(taskID string) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	task, ok := c.tasks[taskID]
+	if ok {
+		task.cancel()
+	}
+	return ok
+}
+
+// Shutdown cancels all tasks with ErrShuttingDown, including those queued
+// later.
+func (c *Cancellations) Shutdown() {
+	c.shutdown(ErrShuttingDown)
+}
+
+// CancelTask asks every runner to cancel the given task. The task is also
+// marked as cancelled in Redis, so a runner that receives it later, e.g. from
+// the tasks stream, drops it instead of running it.
+func CancelTask(ctx context.Context, redisClient *redis.Client, taskID string) error {
+	err := redisClient.Set(ctx, cancelMarkerKey(taskID), "1", cancelMarkerTTL).Err()
+	if err != nil {
+		return err
+	}
+
+	jsonBytes, err := json.Marshal(model.CancelTaskCommand{ID: taskID})
+	if err != nil {
+		return err
+	}
+
+	return redisClient.Publish(ctx, cancelTaskChannel, string(jsonBytes)).Err()
+}
+
+func HandleCancelTaskCommands(
+	ctx context.Context,
+	redisClient *redis.Client,
+	cancellations *Cancellations,
+) {
+	pubsub := redisClient.Subscribe(ctx, cancelTaskChannel)
+	for msg := range pubsub.Channel() {
+		var command model.CancelTaskCommand
+		err := json.Unmarshal([]byte(msg.Payload), &command)
+		if err != nil {
+			logging.FromContext(ctx).Error("Error unmarshaling cancel command", "error", err)
+			continue
+		}
+
+		if cancellations.Cancel(command.ID) {
+			logging.FromContext(ctx).Info("Task cancelled", "task_id", command.ID)
+		}
+	}
+}
+
+func isCancelMarked(ctx context.Context, redisClient *redis.Client, taskID string) bool {
+	err := redisClient.Get(ctx, cancelMarkerKey(taskID)).Err()
+	if err != nil && !errors.Is(err, redis.Nil) {
+		logging.FromContext(ctx).Error("Error checking cancellation", "error", err)
+	}
+	return err == nil
+}
+
+func cancelMarkerKey(taskID string) string {
+	return fmt.Sprintf("task:%s:cancelled", taskID)
+}
+
+// abortTask finishes a task whose context was cancelled, either by a cancel
+// command or by runner shutdown.
+func abortTask(
+	ctx context.Context,
+	redisClient *redis.Client,
+	taskStore taskstore.Store,
+	cancellations *Cancellations,
+	task model.Task,
+) {
+	if cancellations.isInterrupted(task.ID) {
+		interruptTask(ctx, redisClient, taskStore, cancellations, task)
+		return
+	}
+
+	logging.FromContext(ctx).Info("Task cancelled, dropping it")
+	task.SetState(model.CancelledTaskState)
+	publishCompletedTask(ctx, redisClient, taskStore, cancellations, task)
+}
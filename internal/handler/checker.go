@@ -0,0 +1,189 @@
+package handler
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"path"
+	"slices"
+	"strings"
+
+	"github.com/t3m8ch/coderunner/internal/compiler"
+	"github.com/t3m8ch/coderunner/internal/filesctl"
+	"github.com/t3m8ch/coderunner/internal/logging"
+	"github.com/t3m8ch/coderunner/internal/model"
+	"github.com/t3m8ch/coderunner/internal/sandbox"
+)
+
+const defaultJudgeProgramCompiler = "cpp17"
+
+// Exit codes of testlib checkers and interactors.
+const (
+	judgeOK                = 0
+	judgeWrongAnswer       = 1
+	judgePresentationError = 2
+)
+
+// judgeProgram is a compiled checker or interactor.
+type judgeProgram struct {
+	name       string
+	spec       compiler.Spec
+	executable []byte
+}
+
+// prepareJudgeProgram loads and compiles the checker or interactor of a test
+// suite, name is used in errors.
+func prepareJudgeProgram(
+	ctx context.Context,
+	filesManager filesctl.Manager,
+	sandboxManager sandbox.Manager,
+	name string,
+	dto model.JudgeProgramDTO,
+) (*judgeProgram, error) {
+	compilerName := dto.Compiler
+	if compilerName == "" {
+		compilerName = defaultJudgeProgramCompiler
+	}
+	spec, ok := compiler.Lookup(compilerName)
+	if !ok {
+		return nil, fmt.Errorf("unknown %s compiler %q", name, compilerName)
+	}
+
+	source := []byte(dto.Source)
+	if dto.SourceLocation != nil {
+		var err error
+		source, err = filesManager.LoadFile(ctx, dto.SourceLocation.BucketName, dto.SourceLocation.ObjectName)
+		if err != nil {
+			return nil, fmt.Errorf("loading %s source: %w", name, err)
+		}
+	}
+
+	files := map[string][]byte{spec.SourceFile: source}
+	for fileName, location := range dto.Files {
+		if fileName == "" || fileName != path.Base(fileName) {
+			return nil, fmt.Errorf("invalid %s file name %q", name, fileName)
+		}
+		data, err := filesManager.LoadFile(ctx, location.BucketName, location.ObjectName)
+		if err != nil {
+			return nil, fmt.Errorf("loading %s file %s: %w", name, fileName, err)
+		}
+		files[path.Join(path.Dir(spec.SourceFile), fileName)] = data
+	}
+
+	// The same checker is usually shared by many tasks.
+	logger := logging.FromContext(ctx)
+	objectName, err := compileCacheObject(ctx, sandboxManager, compilerName, spec, files)
+	if err != nil {
+		logger.Warn("Error computing compile cache key", "program", name, "error", err)
+	} else {
+		executable, err := loadCachedExecutable(ctx, filesManager, objectName)
+		if err != nil {
+			logger.Error("Error looking up compile cache", "program", name, "error", err)
+		}
+		if executable != nil {
+			return &judgeProgram{name: name, spec: spec, executable: executable}, nil
+		}
+	}
+
+	result, err := compile(ctx, sandboxManager, spec, files)
+	if err != nil {
+		return nil, fmt.Errorf("compiling %s: %w", name, err)
+	}
+	if result.failed {
+		return nil, fmt.Errorf("%s compilation failed: %s", name, truncateOutput(result.output, judgeCommentLimit))
+	}
+
+	if objectName != "" {
+		err = filesManager.PutFile(ctx, execBucketName, objectName, result.artifact)
+		if err != nil {
+			logger.Warn("Error caching executable", "program", name, "error", err)
+		}
+	}
+
+	return &judgeProgram{name: name, spec: spec, executable: result.artifact}, nil
+}
+
+// loadCachedExecutable returns the cached executable, or nil if there is none.
+func loadCachedExecutable(ctx context.Context, filesManager filesctl.Manager, objectName string) ([]byte, error) {
+	cached, err := filesManager.Exists(ctx, execBucketName, objectName)
+	if err != nil || !cached {
+		return nil, err
+	}
+	return filesManager.LoadFile(ctx, execBucketName, objectName)
+}
+
+// cmd returns the command running the program with the testlib arguments.
+func (p *judgeProgram) cmd() []string {
+	return append(slices.Clone(p.spec.RunCmd), inputFilePath, judgeOutputPath, judgeAnswerPath)
+}
+
+// verdict maps the exit code of the program to a verdict.
+func (p *judgeProgram) verdict(result sandbox.WaitResult) (model.Verdict, error) {
+	if result.LimitExceeded != sandbox.NoLimitExceeded {
+		return "", fmt.Errorf("%s exceeded %s limit", p.name, result.LimitExceeded)
+	}
+
+	switch result.StatusCode {
+	case judgeOK:
+		return model.OKVerdict, nil
+	case judgeWrongAnswer:
+		return model.WrongAnswerVerdict, nil
+	case judgePresentationError:
+		return model.PresentationErrorVerdict, nil
+	default:
+		return "", fmt.Errorf("%s failed with exit code %d", p.name, result.StatusCode)
+	}
+}
+
+// check runs the checker on the output of a test and returns its verdict and
+// message.
+func (p *judgeProgram) check(
+	ctx context.Context,
+	sandboxManager sandbox.Manager,
+	test model.Test,
+	output string,
+) (model.Verdict, string, error) {
+	files := []sandboxFile{
+		{p.spec.ExecutablePath, 0755, p.executable},
+		{inputFilePath, 0644, []byte(test.Stdin)},
+		{judgeOutputPath, 0644, []byte(output)},
+		{judgeAnswerPath, 0644, []byte(test.Stdout)},
+	}
+	sandboxID, err := sandboxManager.CreateSandbox(ctx, p.spec.RunImage, p.cmd(), judgeLimits(checkerLimits, files))
+	if err != nil {
+		return "", "", fmt.Errorf("creating checker sandbox: %w", err)
+	}
+
+	defer func() {
+		err := sandboxManager.RemoveSandbox(context.WithoutCancel(ctx), sandboxID)
+		if err != nil {
+			logging.FromContext(ctx).Error("Error removing checker sandbox", "sandbox_id", sandboxID, "error", err)
+		}
+	}()
+
+	for _, file := range files {
+		err = sandboxManager.CopyFileToSandbox(ctx, sandboxID, file.path, file.mode, file.data)
+		if err != nil {
+			return "", "", fmt.Errorf("copying %s to checker sandbox: %w", file.path, err)
+		}
+	}
+
+	err = sandboxManager.StartSandbox(ctx, sandboxID)
+	if err != nil {
+		return "", "", fmt.Errorf("starting checker sandbox: %w", err)
+	}
+
+	result, err := sandboxManager.WaitSandbox(ctx, sandboxID)
+	if err != nil {
+		return "", "", fmt.Errorf("waiting for checker sandbox: %w", err)
+	}
+
+	logs, err := sandboxManager.ReadLogsFromSandbox(ctx, sandboxID)
+	if err != nil && !errors.Is(err, sandbox.ErrOutputLimitExceeded) {
+		return "", "", fmt.Errorf("reading checker output: %w", err)
+	}
+	comment := strings.TrimSpace(truncateOutput(logs.Combined(), judgeCommentLimit))
+
+	verdict, err := p.verdict(result)
+	return verdict, comment, err
+}
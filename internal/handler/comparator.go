@@ -0,0 +1,119 @@
+package handler
+
+import (
+	"fmt"
+	"math"
+	"slices"
+	"strconv"
+	"strings"
+
+	"github.com/t3m8ch/coderunner/internal/model"
+)
+
+// Comparison modes selectable in tests files.
+const (
+	exactComparison              = "exact"
+	trailingWhitespaceComparison = "trailing_whitespace"
+	tokensComparison             = "tokens"
+	caseInsensitiveComparison    = "case_insensitive"
+	floatComparison              = "float"
+	unorderedLinesComparison     = "unordered_lines"
+)
+
+const (
+	defaultComparison   = trailingWhitespaceComparison
+	defaultFloatEpsilon = 1e-6
+)
+
+// comparator reports whether the actual output of a test is correct.
+type comparator func(expected, actual string) bool
+
+func newComparator(dto *model.ComparatorDTO) (comparator, error) {
+	if dto == nil {
+		return compareTrailingWhitespace, nil
+	}
+
+	switch dto.Mode {
+	case exactComparison:
+		return compareExact, nil
+	case "", trailingWhitespaceComparison:
+		return compareTrailingWhitespace, nil
+	case tokensComparison:
+		return compareTokens, nil
+	case caseInsensitiveComparison:
+		return compareCaseInsensitive, nil
+	case floatComparison:
+		absEpsilon, relEpsilon := dto.AbsEpsilon, dto.RelEpsilon
+		if absEpsilon < 0 || relEpsilon < 0 {
+			return nil, fmt.Errorf("negative epsilon in %s comparison", floatComparison)
+		}
+		if absEpsilon == 0 && relEpsilon == 0 {
+			absEpsilon, relEpsilon = defaultFloatEpsilon, defaultFloatEpsilon
+		}
+		return floatComparator(absEpsilon, relEpsilon), nil
+	case unorderedLinesComparison:
+		return compareUnorderedLines, nil
+	default:
+		return nil, fmt.Errorf("unknown comparison mode %q", dto.Mode)
+	}
+}
+
+func compareExact(expected, actual string) bool {
+	return expected == actual
+}
+
+// compareTrailingWhitespace ignores whitespace at the end of lines and empty
+// lines at the end of output.
+func compareTrailingWhitespace(expected, actual string) bool {
+	return slices.Equal(trimmedLines(expected), trimmedLines(actual))
+}
+
+func compareTokens(expected, actual string) bool {
+	return slices.Equal(strings.Fields(expected), strings.Fields(actual))
+}
+
+func compareCaseInsensitive(expected, actual string) bool {
+	return slices.EqualFunc(strings.Fields(expected), strings.Fields(actual), strings.EqualFold)
+}
+
+// floatComparator compares output token-wise, numbers match if they differ by
+// at most absEpsilon or by at most relEpsilon relative to the expected value.
+func floatComparator(absEpsilon, relEpsilon float64) comparator {
+	return func(expected, actual string) bool {
+		return slices.EqualFunc(strings.Fields(expected), strings.Fields(actual), func(e, a string) bool {
+			if e == a {
+				return true
+			}
+			expectedValue, err := strconv.ParseFloat(e, 64)
+			if err != nil {
+				return false
+			}
+			actualValue, err := strconv.ParseFloat(a, 64)
+			if err != nil || math.IsNaN(actualValue) {
+				return false
+			}
+			diff := math.Abs(expectedValue - actualValue)
+			return diff <= absEpsilon || diff <= relEpsilon*math.Abs(expectedValue)
+		})
+	}
+}
+
+// compareUnorderedLines compares the lines of output as a multiset, ignoring
+// trailing whitespace.
+func compareUnorderedLines(expected, actual string) bool {
+	expectedLines, actualLines := trimmedLines(expected), trimmedLines(actual)
+	slices.Sort(expectedLines)
+	slices.Sort(actualLines)
+	return slices.Equal(expectedLines, actualLines)
+}
+
+func trimmedLines(output string) []string {
+	lines := strings.Split(output, "\n")
+	for i := range lines {
+		lines[i] = strings.TrimRight(lines[i], " \t\r")
+	}
+	for len(lines) > 0 && lines[len(lines)-1] == "" {
+		lines = lines[:len(lines)-1]
+	}
+	return lines
+}
@@ -0,0 +1,40 @@
+package handler
+
+import (
+	"context"
+	"crypto/sha256"
+	"fmt"
+	"maps"
+	"slices"
+
+	"github.com/t3m8ch/coderunner/internal/compiler"
+	"github.com/t3m8ch/coderunner/internal/sandbox"
+)
+
+// compileCacheObject returns the name of the object in execBucketName holding
+// the executable built from files by the compiler. Identical sources get the
+// same name, unless the compiler image was updated in the meantime.
+func compileCacheObject(
+	ctx context.Context,
+	sandboxManager sandbox.Manager,
+	compilerID string,
+	spec compiler.Spec,
+	files map[string][]byte,
+) (string, error) {
+	digest, err := sandboxManager.ImageDigest(ctx, spec.CompileImage)
+	if err != nil {
+		return "", fmt.Errorf("getting digest of %s: %w", spec.CompileImage, err)
+	}
+
+	hash := sha256.New()
+	parts := append([]string{compilerID, digest, spec.SourceFile, spec.ArtifactPath}, spec.CompileCmd...)
+	for _, part := range parts {
+		fmt.Fprintf(hash, "%d:%s\n", len(part), part)
+	}
+	for _, path := range slices.Sorted(maps.Keys(files)) {
+		fmt.Fprintf(hash, "%d:%s\n%d:", len(path), path, len(files[path]))
+		hash.Write(files[path])
+	}
+
+	return fmt.Sprintf("cache/%x.out", hash.Sum(nil)), nil
+}
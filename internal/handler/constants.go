@@ -1,12 +1,21 @@
 package handler
 
+import "github.com/t3m8ch/coderunner/internal/sandbox"
+
 const (
-	taskChannel           = "coderunner_task_channel"
-	completedTestsChannel = "coderunner_completed_tests_channel"
-	completedTasksChannel = "coderunner_completed_tasks_channel"
-	sourceFilePath        = "/app/main.cpp"
-	compileExecPath       = "/app/output"
-	execBucketName        = "executables"
-	testingExecPath       = "/app/exec.out"
-	inputFilePath         = "/app/input.txt"
+	taskChannel            = "coderunner_task_channel"
+	taskStream             = "coderunner_task_stream"
+	taskStreamGroup        = "coderunner_runners"
+	taskStreamPayloadField = "payload"
+	taskDeadLetterStream   = "coderunner_task_dead_letter_stream"
+	completedTestsChannel  = "coderunner_completed_tests_channel"
+	completedTasksChannel  = "coderunner_completed_tasks_channel"
+	cancelTaskChannel      = "coderunner_cancel_task_channel"
+	rejudgeTaskChannel     = "coderunner_rejudge_task_channel"
+	execBucketName         = "executables"
+	inputFilePath          = sandbox.WorkDir + "/input.txt"
+	judgeOutputPath        = sandbox.WorkDir + "/output.txt"
+	judgeAnswerPath        = sandbox.WorkDir + "/answer.txt"
+	judgeCommentLimit      = 4 << 10
+	stderrLimit            = 4 << 10
 )
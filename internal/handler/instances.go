@@ -0,0 +1,50 @@
+package handler
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+	"github.com/t3m8ch/coderunner/internal/logging"
+	"github.com/t3m8ch/coderunner/internal/sandbox"
+)
+
+const instanceHeartbeatTTL = 30 * time.Second
+
+// KeepInstanceAlive periodically marks the runner instance as alive in Redis
+// until ctx is cancelled. Other runners sharing the Docker host use the mark
+// to tell whether the sandboxes of this instance are orphaned.
+func KeepInstanceAlive(ctx context.Context, redisClient *redis.Client, instanceID string) {
+	ticker := time.NewTicker(instanceHeartbeatTTL / 3)
+	defer ticker.Stop()
+
+	for {
+		err := redisClient.Set(ctx, instanceKey(instanceID), "1", instanceHeartbeatTTL).Err()
+		if err != nil && ctx.Err() == nil {
+			logging.FromContext(ctx).Error("Error sending heartbeat", "error", err)
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// InstanceChecker reports a runner instance as alive while its heartbeat
+// hasn't expired.
+func InstanceChecker(redisClient *redis.Client) sandbox.InstanceChecker {
+	return func(ctx context.Context, instanceID string) (bool, error) {
+		count, err := redisClient.Exists(ctx, instanceKey(instanceID)).Result()
+		if err != nil {
+			return false, err
+		}
+		return count > 0, nil
+	}
+}
+
+func instanceKey(instanceID string) string {
+	return fmt.Sprintf("runner:%s:alive", instanceID)
+}
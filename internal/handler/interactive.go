@@ -0,0 +1,255 @@
+package handler
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"strings"
+	"sync"
+
+	"github.com/t3m8ch/coderunner/internal/compiler"
+	"github.com/t3m8ch/coderunner/internal/logging"
+	"github.com/t3m8ch/coderunner/internal/model"
+	"github.com/t3m8ch/coderunner/internal/sandbox"
+)
+
+type sandboxFile struct {
+	path string
+	mode int64
+	data []byte
+}
+
+// runInteractiveTest runs the solution and the interactor in separate
+// sandboxes with the stdout of each one connected to the stdin of the other.
+func runInteractiveTest(
+	ctx context.Context,
+	sandboxManager sandbox.Manager,
+	spec compiler.Spec,
+	limits sandbox.Limits,
+	executable []byte,
+	interactor *judgeProgram,
+	testChecker *judgeProgram,
+	taskID string,
+	test model.Test,
+) model.TestResult {
+	logger := logging.FromContext(ctx)
+	logger.Debug("Running interactive test")
+
+	testResult := model.TestResult{
+		TaskID:  taskID,
+		TestID:  test.ID,
+		Verdict: model.InternalErrorVerdict,
+	}
+
+	solutionID, solution, err := createAttachedSandbox(
+		ctx,
+		sandboxManager,
+		spec.RunImage,
+		spec.RunCmd,
+		limits,
+		[]sandboxFile{{spec.ExecutablePath, 0555, executable}},
+	)
+	if solutionID != "" {
+		defer removeSandbox(ctx, sandboxManager, solutionID)
+	}
+	defer solution.Close()
+	if err != nil {
+		logger.Error("Error preparing solution sandbox", "error", err)
+		return testResult
+	}
+
+	interactorFiles := []sandboxFile{
+		{interactor.spec.ExecutablePath, 0755, interactor.executable},
+		{inputFilePath, 0644, []byte(test.Stdin)},
+		{judgeAnswerPath, 0644, []byte(test.Stdout)},
+	}
+	interactorSandboxLimits := judgeLimits(interactorLimits(limits), interactorFiles)
+	interactorID, interactorStreams, err := createAttachedSandbox(
+		ctx,
+		sandboxManager,
+		interactor.spec.RunImage,
+		interactor.cmd(),
+		interactorSandboxLimits,
+		interactorFiles,
+	)
+	if interactorID != "" {
+		defer removeSandbox(ctx, sandboxManager, interactorID)
+	}
+	defer interactorStreams.Close()
+	if err != nil {
+		logger.Error("Error preparing interactor sandbox", "error", err)
+		return testResult
+	}
+
+	for _, id := range []sandbox.SandboxID{interactorID, solutionID} {
+		err = sandboxManager.StartSandbox(ctx, id)
+		if err != nil {
+			logger.Error("Error starting sandbox", "sandbox_id", id, "error", err)
+			return testResult
+		}
+	}
+	logger.Debug("Sandboxes started", "solution_sandbox_id", solutionID, "interactor_sandbox_id", interactorID)
+
+	var (
+		streams                sync.WaitGroup
+		solutionOutputExceeded bool
+		solutionStderr         string
+		interactorComment      []byte
+	)
+	streams.Add(4)
+	go func() {
+		defer streams.Done()
+		solutionOutputExceeded = pipeStream(interactorStreams.Stdin, solution.Stdout, limits.Output)
+	}()
+	go func() {
+		defer streams.Done()
+		pipeStream(solution.Stdin, interactorStreams.Stdout, interactorSandboxLimits.Output)
+	}()
+	go func() {
+		defer streams.Done()
+		solutionStderr, _ = readStream(solution.Stderr, stderrLimit)
+	}()
+	go func() {
+		defer streams.Done()
+		interactorComment, _ = io.ReadAll(io.LimitReader(interactorStreams.Stderr, judgeCommentLimit))
+		io.Copy(io.Discard, interactorStreams.Stderr)
+	}()
+
+	var (
+		waits                      sync.WaitGroup
+		solutionResult             sandbox.WaitResult
+		interactorResult           sandbox.WaitResult
+		solutionErr, interactorErr error
+	)
+	waits.Add(2)
+	go func() {
+		defer waits.Done()
+		solutionResult, solutionErr = sandboxManager.WaitSandbox(ctx, solutionID)
+	}()
+	go func() {
+		defer waits.Done()
+		interactorResult, interactorErr = sandboxManager.WaitSandbox(ctx, interactorID)
+	}()
+	waits.Wait()
+	if solutionErr != nil || interactorErr != nil {
+		// The streams only end once the sandboxes exit.
+		solution.Close()
+		interactorStreams.Close()
+	} else {
+		// Both have exited, whatever is left for their input has no reader.
+		solution.Stdin.Close()
+		interactorStreams.Stdin.Close()
+	}
+	streams.Wait()
+
+	if solutionErr != nil {
+		logger.Error("Error waiting for solution sandbox", "sandbox_id", solutionID, "error", solutionErr)
+		return testResult
+	}
+	if solutionOutputExceeded && solutionResult.LimitExceeded == sandbox.NoLimitExceeded {
+		solutionResult.LimitExceeded = sandbox.OutputLimitExceeded
+	}
+	logger.Debug(
+		"Solution completed",
+		"exit_code", solutionResult.StatusCode,
+		"limit_exceeded", solutionResult.LimitExceeded,
+		"wall_time", solutionResult.WallTime,
+	)
+
+	testResult.ExitCode = solutionResult.StatusCode
+	testResult.Signal = solutionResult.Signal
+	testResult.WallTimeMs = solutionResult.WallTime.Milliseconds()
+	testResult.CPUTimeMs = solutionResult.CPUTime.Milliseconds()
+	testResult.PeakMemoryBytes = solutionResult.PeakMemory
+	testResult.Stderr = strings.ToValidUTF8(solutionStderr, "")
+	testResult.Comment = strings.TrimSpace(string(interactorComment))
+
+	// A solution that ran out of its limits gets the limit verdict, even if it
+	// made the interactor fail. Otherwise the interactor decides, e.g. a
+	// solution killed by SIGPIPE after a wrong answer gets WA.
+	if solutionResult.LimitExceeded != sandbox.NoLimitExceeded {
+		testResult.Verdict = testVerdict(solutionResult)
+		return testResult
+	}
+	if interactorErr != nil {
+		logger.Error("Error waiting for interactor sandbox", "sandbox_id", interactorID, "error", interactorErr)
+		return testResult
+	}
+
+	verdict, err := interactor.verdict(interactorResult)
+	if err != nil {
+		logger.Warn("Interactor failed", "error", err)
+		testResult.Comment = strings.TrimSpace(err.Error() + "\n" + testResult.Comment)
+		return testResult
+	}
+	if verdict == model.OKVerdict {
+		verdict = testVerdict(solutionResult)
+	}
+	if verdict == model.OKVerdict && testChecker != nil {
+		verdict, testResult.Comment, err = checkInteraction(ctx, sandboxManager, interactorID, testChecker, test)
+		if err != nil {
+			logger.Error("Error running checker", "error", err)
+			verdict = model.InternalErrorVerdict
+			testResult.Comment = strings.TrimSpace(err.Error() + "\n" + testResult.Comment)
+		}
+	}
+
+	testResult.Verdict = verdict
+	testResult.Successful = verdict == model.OKVerdict
+	logger.Debug("Test completed", "verdict", verdict)
+
+	return testResult
+}
+
+// checkInteraction runs the checker on the output file the interactor wrote.
+func checkInteraction(
+	ctx context.Context,
+	sandboxManager sandbox.Manager,
+	interactorID sandbox.SandboxID,
+	testChecker *judgeProgram,
+	test model.Test,
+) (model.Verdict, string, error) {
+	output, err := sandboxManager.LoadFileFromSandbox(ctx, interactorID, judgeOutputPath)
+	if err != nil {
+		return "", "", fmt.Errorf("loading interactor output: %w", err)
+	}
+	return testChecker.check(ctx, sandboxManager, test, string(output))
+}
+
+// createAttachedSandbox creates a sandbox with the given files and attaches
+// to it. The returned ID is set whenever the sandbox was created.
+func createAttachedSandbox(
+	ctx context.Context,
+	sandboxManager sandbox.Manager,
+	image string,
+	cmd []string,
+	limits sandbox.Limits,
+	files []sandboxFile,
+) (sandbox.SandboxID, *sandbox.Attachment, error) {
+	id, err := sandboxManager.CreateSandbox(ctx, image, cmd, limits)
+	if err != nil {
+		return "", nil, fmt.Errorf("creating sandbox: %w", err)
+	}
+
+	for _, file := range files {
+		err = sandboxManager.CopyFileToSandbox(ctx, id, file.path, file.mode, file.data)
+		if err != nil {
+			return id, nil, fmt.Errorf("copying %s to sandbox: %w", file.path, err)
+		}
+	}
+
+	attachment, err := sandboxManager.AttachToSandbox(ctx, id)
+	if err != nil {
+		return id, nil, fmt.Errorf("attaching to sandbox: %w", err)
+	}
+
+	return id, attachment, nil
+}
+
+func removeSandbox(ctx context.Context, sandboxManager sandbox.Manager, id sandbox.SandboxID) {
+	// The sandbox must be removed even if the task was cancelled.
+	err := sandboxManager.RemoveSandbox(context.WithoutCancel(ctx), id)
+	if err != nil {
+		logging.FromContext(ctx).Error("Error removing sandbox", "sandbox_id", id, "error", err)
+	}
+}
@@ -0,0 +1,76 @@
+package handler
+
+import (
+	"time"
+
+	"github.com/t3m8ch/coderunner/internal/model"
+	"github.com/t3m8ch/coderunner/internal/sandbox"
+)
+
+var compileLimits = sandbox.Limits{
+	WallTime: 60 * time.Second,
+	CPUTime:  30 * time.Second,
+	Memory:   1024 << 20,
+	Pids:     256,
+	Output:   1 << 20,
+}
+
+var checkerLimits = sandbox.Limits{
+	WallTime:    30 * time.Second,
+	CPUTime:     10 * time.Second,
+	Memory:      512 << 20,
+	Pids:        64,
+	Output:      1 << 20,
+	WorkDirSize: 64 << 20,
+}
+
+// judgeLimits makes room in the work dir for the files given to a checker or
+// interactor, which may be as large as the output of a test, on top of the
+// room it has for its own files.
+func judgeLimits(limits sandbox.Limits, files []sandboxFile) sandbox.Limits {
+	for _, file := range files {
+		limits.WorkDirSize += int64(len(file.data))
+	}
+	return limits
+}
+
+// interactorLimits gives the interactor enough time to outlive the solution
+// it talks to.
+func interactorLimits(solutionLimits sandbox.Limits) sandbox.Limits {
+	result := checkerLimits
+	result.WallTime = max(result.WallTime, 2*solutionLimits.WallTime)
+	result.CPUTime = max(result.CPUTime, 2*solutionLimits.CPUTime)
+	result.Output = 64 << 20
+	return result
+}
+
+var defaultTestLimits = sandbox.Limits{
+	WallTime: 3 * time.Second,
+	CPUTime:  time.Second,
+	Memory:   256 << 20,
+	Pids:     64,
+	Output:   64 << 20,
+}
+
+func testLimits(limits model.Limits) sandbox.Limits {
+	result := defaultTestLimits
+	if limits.CPUTimeLimitMs > 0 {
+		result.CPUTime = time.Duration(limits.CPUTimeLimitMs) * time.Millisecond
+		// Give the process enough wall time to use up its CPU time even when
+		// the host is busy, unless the problem setter says otherwise.
+		result.WallTime = 3 * result.CPUTime
+	}
+	if limits.WallTimeLimitMs > 0 {
+		result.WallTime = time.Duration(limits.WallTimeLimitMs) * time.Millisecond
+	}
+	if limits.MemoryLimitMb > 0 {
+		result.Memory = limits.MemoryLimitMb << 20
+	}
+	if limits.PidsLimit > 0 {
+		result.Pids = limits.PidsLimit
+	}
+	if limits.OutputLimitKb > 0 {
+		result.Output = limits.OutputLimitKb << 10
+	}
+	return result
+}
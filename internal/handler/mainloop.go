@@ -4,42 +4,188 @@ import (
 	"context"
 	"encoding/json"
 	"fmt"
+	"strings"
 
 	"github.com/redis/go-redis/v9"
+	"github.com/t3m8ch/coderunner/internal/compiler"
+	"github.com/t3m8ch/coderunner/internal/logging"
 	"github.com/t3m8ch/coderunner/internal/model"
+	"github.com/t3m8ch/coderunner/internal/taskstore"
+	"go.opentelemetry.io/otel/trace"
 )
 
 func HandleStartTaskCommands(
 	ctx context.Context,
 	redisClient *redis.Client,
+	taskStore taskstore.Store,
+	cancellations *Cancellations,
 	tasksToCompile chan model.Task,
 ) {
 	pubsub := redisClient.Subscribe(ctx, taskChannel)
-	for msg := range pubsub.Channel() {
-		var taskCommand model.StartTaskCommand
-		err := json.Unmarshal([]byte(msg.Payload), &taskCommand)
-		if err != nil {
-			fmt.Printf("Error unmarshaling task: %v\n", err)
-			continue
-		}
+	defer pubsub.Close()
 
-		fmt.Printf("Received task: %+v\n", taskCommand)
+	// Cancelling ctx only stops receiving new tasks, the received one is
+	// still submitted.
+	submitCtx := context.WithoutCancel(ctx)
 
-		task := model.Task{
-			ID:            taskCommand.ID,
-			CodeLocation:  taskCommand.CodeLocation,
-			TestsLocation: taskCommand.TestsLocation,
-			Compiler:      taskCommand.Compiler,
-			State:         model.CompilingTaskState,
+	messages := pubsub.Channel()
+	for {
+		var msg *redis.Message
+		select {
+		case <-ctx.Done():
+			return
+		case msg = <-messages:
 		}
-		jsonBytes, err := json.Marshal(task)
+
+		task, err := parseStartTaskCommand(msg.Payload)
 		if err != nil {
-			fmt.Printf("Error marshaling task: %v\n", err)
+			logging.FromContext(ctx).Error("Error unmarshaling task", "error", err)
 			continue
 		}
 
-		redisClient.Set(ctx, fmt.Sprintf("task:%s", taskCommand.ID), string(jsonBytes), 0)
+		submitTask(submitCtx, redisClient, taskStore, cancellations, task, tasksToCompile)
+	}
+}
+
+func parseStartTaskCommand(payload string) (model.Task, error) {
+	var taskCommand model.StartTaskCommand
+	err := json.Unmarshal([]byte(payload), &taskCommand)
+	if err != nil {
+		return model.Task{}, err
+	}
+
+	return newTask(taskCommand), nil
+}
+
+func newTask(taskCommand model.StartTaskCommand) model.Task {
+	return model.Task{
+		ID:            taskCommand.ID,
+		CodeLocation:  taskCommand.CodeLocation,
+		TestsLocation: taskCommand.TestsLocation,
+		Compiler:      taskCommand.Compiler,
+		TraceContext:  taskCommand.TraceContext,
+	}
+}
+
+// SubmitTask queues a task received from a source other than Redis, such as
+// the HTTP API, and returns it in its initial state. It returns
+// taskstore.ErrExists if there is a task with the same ID.
+func SubmitTask(
+	ctx context.Context,
+	redisClient *redis.Client,
+	taskStore taskstore.Store,
+	cancellations *Cancellations,
+	taskCommand model.StartTaskCommand,
+	tasksToCompile chan model.Task,
+) (model.Task, error) {
+	task := newTask(taskCommand)
+	task.SetState(model.QueuedTaskState)
+	err := taskStore.Create(ctx, task)
+	if err != nil {
+		return model.Task{}, err
+	}
+	return submitTask(ctx, redisClient, taskStore, cancellations, task, tasksToCompile), nil
+}
+
+func submitTask(
+	ctx context.Context,
+	redisClient *redis.Client,
+	taskStore taskstore.Store,
+	cancellations *Cancellations,
+	task model.Task,
+	tasksToCompile chan model.Task,
+) model.Task {
+	tasksReceived.Inc()
+	ctx, span := startTaskSpan(ctx, task)
+	ctx = logging.With(ctx, "task_id", task.ID)
+	logging.FromContext(ctx).Info("Task received", "compiler", task.Compiler)
+
+	intakeCtx, intake := tracer.Start(ctx, "intake")
+	if isCancelMarked(intakeCtx, redisClient, task.ID) {
+		intake.End()
+		task.SetState(model.CancelledTaskState)
+		publishCompletedTask(ctx, redisClient, taskStore, cancellations, task)
+		span.End()
+		return task
+	}
 
-		tasksToCompile <- task
+	if _, ok := compiler.Lookup(task.Compiler); !ok {
+		logging.FromContext(ctx).Warn("Unknown compiler", "compiler", task.Compiler)
+		task.Error = fmt.Sprintf(
+			"unknown compiler %q, supported: %s",
+			task.Compiler,
+			strings.Join(compiler.Names(), ", "),
+		)
+		task.SetState(model.FailedTaskState)
+		intake.End()
+		publishCompletedTask(ctx, redisClient, taskStore, cancellations, task)
+		span.End()
+		return task
 	}
+
+	task.SetState(model.QueuedTaskState)
+	saveTask(intakeCtx, taskStore, task)
+	cancellations.register(ctx, task.ID)
+	intake.End()
+
+	tasksToCompile <- task
+	return task
+}
+
+func saveTask(ctx context.Context, taskStore taskstore.Store, task model.Task) {
+	err := taskStore.Save(ctx, task)
+	if err != nil {
+		logging.FromContext(ctx).Error("Error saving task", "error", err)
+	}
+}
+
+func publishCompletedTask(
+	ctx context.Context,
+	redisClient *redis.Client,
+	taskStore taskstore.Store,
+	cancellations *Cancellations,
+	task model.Task,
+) {
+	// The task is released last, which ends its span.
+	defer cancellations.release(task.ID)
+
+	taskSpan := trace.SpanFromContext(cancellations.context(ctx, task.ID))
+	recordTaskOutcome(taskSpan, task)
+	ctx, span := tracer.Start(trace.ContextWithSpan(ctx, taskSpan), "publish")
+	defer span.End()
+
+	saveTask(ctx, taskStore, task)
+	tasksCompleted.WithLabelValues(task.State, task.Verdict).Inc()
+
+	jsonBytes, err := json.Marshal(task)
+	if err != nil {
+		logging.FromContext(ctx).Error("Error marshaling task", "error", err)
+		return
+	}
+
+	redisClient.Publish(ctx, completedTasksChannel, string(jsonBytes))
+
+	if task.StreamMessageID != "" {
+		ackStreamMessage(ctx, redisClient, task.StreamMessageID)
+	}
+}
+
+func failTask(
+	ctx context.Context,
+	redisClient *redis.Client,
+	taskStore taskstore.Store,
+	cancellations *Cancellations,
+	task model.Task,
+	err error,
+) {
+	// Errors of a cancelled task are most likely caused by the cancellation.
+	if cancellations.isCancelled(task.ID) {
+		abortTask(ctx, redisClient, taskStore, cancellations, task)
+		return
+	}
+
+	task.Verdict = model.InternalErrorVerdict
+	task.Error = err.Error()
+	task.SetState(model.FailedTaskState)
+	publishCompletedTask(ctx, redisClient, taskStore, cancellations, task)
 }
@@ -0,0 +1,51 @@
+package handler
+
+import (
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/t3m8ch/coderunner/internal/model"
+)
+
+var (
+	tasksReceived = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "coderunner_tasks_received_total",
+		Help: "Tasks received for judging, including rejudged ones.",
+	})
+	tasksCompleted = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "coderunner_tasks_completed_total",
+		Help: "Tasks that reached a final state, by state and verdict.",
+	}, []string{"state", "verdict"})
+	compileDuration = promauto.NewHistogram(prometheus.HistogramOpts{
+		Name:    "coderunner_compile_duration_seconds",
+		Help:    "Duration of compilations, including the sandbox setup.",
+		Buckets: prometheus.ExponentialBuckets(0.25, 2, 10),
+	})
+	testDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "coderunner_test_duration_seconds",
+		Help:    "Duration of single tests, including the sandbox setup and checking, by verdict.",
+		Buckets: prometheus.ExponentialBuckets(0.01, 2, 12),
+	}, []string{"verdict"})
+)
+
+// RegisterQueueMetrics exposes the number of tasks waiting in the queues.
+func RegisterQueueMetrics(tasksToCompile, tasksToTest chan model.Task) {
+	promauto.NewGaugeFunc(prometheus.GaugeOpts{
+		Name: "coderunner_tasks_to_compile_queued",
+		Help: "Tasks waiting for a compile worker.",
+	}, func() float64 {
+		return float64(len(tasksToCompile))
+	})
+	promauto.NewGaugeFunc(prometheus.GaugeOpts{
+		Name: "coderunner_tasks_to_test_queued",
+		Help: "Tasks waiting for a test worker.",
+	}, func() float64 {
+		return float64(len(tasksToTest))
+	})
+}
+
+func observeTest(start time.Time, result model.TestResult) model.TestResult {
+	testDuration.WithLabelValues(result.Verdict).Observe(time.Since(start).Seconds())
+	return result
+}
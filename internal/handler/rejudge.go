@@ -0,0 +1,162 @@
+package handler
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+	"github.com/t3m8ch/coderunner/internal/logging"
+	"github.com/t3m8ch/coderunner/internal/model"
+	"github.com/t3m8ch/coderunner/internal/taskstore"
+)
+
+const rejudgeClaimTTL = 24 * time.Hour
+
+// HandleRejudgeTaskCommands receives RejudgeTaskCommands until ctx is
+// cancelled. Every runner receives them, and each task is rejudged by the
+// runner that claims its next revision first.
+func HandleRejudgeTaskCommands(
+	ctx context.Context,
+	redisClient *redis.Client,
+	taskStore taskstore.Store,
+	cancellations *Cancellations,
+	tasksToCompile chan model.Task,
+) {
+	pubsub := redisClient.Subscribe(ctx, rejudgeTaskChannel)
+	defer pubsub.Close()
+
+	submitCtx := context.WithoutCancel(ctx)
+
+	messages := pubsub.Channel()
+	for {
+		var msg *redis.Message
+		select {
+		case <-ctx.Done():
+			return
+		case msg = <-messages:
+		}
+
+		var command model.RejudgeTaskCommand
+		err := json.Unmarshal([]byte(msg.Payload), &command)
+		if err != nil {
+			logging.FromContext(ctx).Error("Error unmarshaling rejudge command", "error", err)
+			continue
+		}
+
+		_, err = RejudgeTasks(submitCtx, redisClient, taskStore, cancellations, command, tasksToCompile)
+		if err != nil {
+			logging.FromContext(ctx).Error("Error rejudging tasks", "error", err)
+		}
+	}
+}
+
+// RejudgeTasks queues the finished tasks selected by the command for testing
+// against the current tests and returns them. A task keeps the executable it
+// was compiled to, if any, and its earlier results are kept as a revision.
+// Tasks that are still running are skipped. A task that fails to be queued
+// doesn't stop the others, the failures are returned along with the tasks
+// that were queued, and the failed ones may be rejudged again.
+func RejudgeTasks(
+	ctx context.Context,
+	redisClient *redis.Client,
+	taskStore taskstore.Store,
+	cancellations *Cancellations,
+	command model.RejudgeTaskCommand,
+	tasksToCompile chan model.Task,
+) ([]model.Task, error) {
+	tasks, err := selectTasks(ctx, taskStore, command)
+	if err != nil {
+		return nil, err
+	}
+
+	rejudged := make([]model.Task, 0, len(tasks))
+	var errs []error
+	for _, task := range tasks {
+		if !task.Finished() {
+			logging.FromContext(ctx).Info("Not rejudging unfinished task", "task_id", task.ID, "state", task.State)
+			continue
+		}
+
+		task.Rejudge()
+		claimKey := rejudgeClaimKey(task.ID, task.Revision)
+		claimed, err := redisClient.SetNX(ctx, claimKey, 1, rejudgeClaimTTL).Result()
+		if err != nil {
+			errs = append(errs, fmt.Errorf("claiming task %s: %w", task.ID, err))
+			continue
+		}
+		if !claimed {
+			// Another runner has rejudged it already.
+			continue
+		}
+
+		taskCtx, span := startTaskSpan(ctx, task)
+		taskCtx = logging.With(taskCtx, "task_id", task.ID)
+		task.SetState(model.QueuedTaskState)
+		err = taskStore.Save(taskCtx, task)
+		if err != nil {
+			err = fmt.Errorf("saving task %s: %w", task.ID, err)
+			logging.FromContext(taskCtx).Error("Error queueing task for rejudging", "error", err)
+			span.End()
+			// Nothing has changed, so the task can be claimed again.
+			if delErr := redisClient.Del(ctx, claimKey).Err(); delErr != nil {
+				logging.FromContext(taskCtx).Error("Error releasing rejudge claim", "error", delErr)
+			}
+			errs = append(errs, err)
+			continue
+		}
+
+		logging.FromContext(taskCtx).Info("Rejudging task", "revision", task.Revision)
+		tasksReceived.Inc()
+		cancellations.register(taskCtx, task.ID)
+
+		tasksToCompile <- task
+		rejudged = append(rejudged, task)
+	}
+
+	return rejudged, errors.Join(errs...)
+}
+
+func selectTasks(ctx context.Context, taskStore taskstore.Store, command model.RejudgeTaskCommand) ([]model.Task, error) {
+	ids := command.IDs
+	if command.ID != "" {
+		ids = append([]string{command.ID}, ids...)
+	}
+
+	seen := make(map[string]bool)
+	var tasks []model.Task
+	for _, id := range ids {
+		if seen[id] {
+			continue
+		}
+		task, err := taskStore.Get(ctx, id)
+		if err != nil {
+			return nil, fmt.Errorf("task %s: %w", id, err)
+		}
+		seen[id] = true
+		tasks = append(tasks, task)
+	}
+
+	if command.TestsLocation != nil {
+		byTests, err := taskStore.ListByTestsLocation(ctx, *command.TestsLocation)
+		if err != nil {
+			return nil, err
+		}
+		for _, task := range byTests {
+			// The index keeps the tasks that were moved to other tests.
+			if seen[task.ID] || task.TestsLocation != *command.TestsLocation {
+				continue
+			}
+			seen[task.ID] = true
+			tasks = append(tasks, task)
+		}
+	}
+
+	return tasks, nil
+}
+
+func rejudgeClaimKey(taskID string, revision int) string {
+	return fmt.Sprintf("task:%s:rejudge:%d", taskID, revision)
+}
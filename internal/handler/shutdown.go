@@ -0,0 +1,36 @@
+package handler
+
+import (
+	"context"
+
+	"github.com/redis/go-redis/v9"
+	"github.com/t3m8ch/coderunner/internal/logging"
+	"github.com/t3m8ch/coderunner/internal/model"
+	"github.com/t3m8ch/coderunner/internal/taskstore"
+)
+
+// interruptTask gives up a task the runner couldn't finish before shutting
+// down. Tasks from the stream are left unacknowledged so that another runner
+// claims them, other tasks can't be redelivered and are failed.
+func interruptTask(
+	ctx context.Context,
+	redisClient *redis.Client,
+	taskStore taskstore.Store,
+	cancellations *Cancellations,
+	task model.Task,
+) {
+	if task.StreamMessageID != "" {
+		logging.FromContext(ctx).Info("Task interrupted by shutdown, leaving it to other runners")
+		cancellations.release(task.ID)
+		task.TestsResults = nil
+		task.SetState(model.QueuedTaskState)
+		saveTask(ctx, taskStore, task)
+		return
+	}
+
+	logging.FromContext(ctx).Warn("Task interrupted by shutdown, failing it")
+	task.Verdict = model.InternalErrorVerdict
+	task.Error = "runner shut down before the task finished"
+	task.SetState(model.FailedTaskState)
+	publishCompletedTask(ctx, redisClient, taskStore, cancellations, task)
+}
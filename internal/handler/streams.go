@@ -0,0 +1,38 @@
+package handler
+
+import (
+	"bytes"
+	"io"
+)
+
+// pipeStream copies src to dst until EOF and closes dst. Data beyond limit,
+// or that can't be written anymore, is discarded so that the writing side is
+// never blocked. Writes to the stdin of a sandbox only fail once it has
+// exited, or once the stdin is closed, so dst must be closed when the reading
+// sandbox can't be waited for. It reports whether the limit was exceeded.
+func pipeStream(dst io.WriteCloser, src io.Reader, limit int64) bool {
+	var err error
+	if limit > 0 {
+		_, err = io.CopyN(dst, src, limit)
+	} else {
+		_, err = io.Copy(dst, src)
+	}
+	dst.Close()
+
+	n, _ := io.Copy(io.Discard, src)
+	return limit > 0 && err == nil && n > 0
+}
+
+// readStream reads src until EOF, keeping at most limit bytes. It reports
+// whether the limit was exceeded.
+func readStream(src io.Reader, limit int64) (string, bool) {
+	var buf bytes.Buffer
+	if limit <= 0 {
+		io.Copy(&buf, src)
+		return buf.String(), false
+	}
+
+	io.CopyN(&buf, src, limit)
+	n, _ := io.Copy(io.Discard, src)
+	return buf.String(), n > 0
+}
@@ -0,0 +1,295 @@
+package handler
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+	"github.com/t3m8ch/coderunner/internal/logging"
+	"github.com/t3m8ch/coderunner/internal/model"
+	"github.com/t3m8ch/coderunner/internal/taskstore"
+)
+
+const (
+	streamReadCount  = 10
+	streamReadBlock  = 5 * time.Second
+	streamRetryDelay = time.Second
+	// maxStreamDeliveries is how often a message is handed to runners before
+	// it is taken for one that crashes or hangs them.
+	maxStreamDeliveries = 5
+)
+
+// HandleStartTaskStream reads StartTaskCommands from the tasks stream as a
+// member of the runners' consumer group. A message is acknowledged only after
+// the task result has been published, so tasks survive runner restarts.
+// Messages of consumers that stopped renewing them for longer than claimIdle
+// are claimed by the remaining runners, until maxStreamDeliveries is reached.
+// Then the task fails and the message is moved to the dead letter stream.
+func HandleStartTaskStream(
+	ctx context.Context,
+	redisClient *redis.Client,
+	taskStore taskstore.Store,
+	cancellations *Cancellations,
+	tasksToCompile chan model.Task,
+	consumer string,
+	claimIdle time.Duration,
+) {
+	err := redisClient.XGroupCreateMkStream(ctx, taskStream, taskStreamGroup, "0").Err()
+	if err != nil && !strings.HasPrefix(err.Error(), "BUSYGROUP") {
+		logging.FromContext(ctx).Error("Error creating consumer group", "error", err)
+	}
+
+	// Cancelling ctx only stops receiving new tasks. Received tasks are still
+	// submitted and renewed while the runner drains them.
+	submitCtx := context.WithoutCancel(ctx)
+
+	go renewStreamMessages(submitCtx, redisClient, consumer, claimIdle/3)
+
+	claimed := make(chan redis.XMessage)
+	go claimStreamMessages(ctx, redisClient, consumer, claimIdle, claimed)
+
+	read := make(chan redis.XMessage)
+	go readStreamMessages(ctx, redisClient, consumer, read)
+
+	for {
+		var msg redis.XMessage
+		select {
+		case <-ctx.Done():
+			return
+		case msg = <-read:
+		case msg = <-claimed:
+			deliveries := streamMessageDeliveries(submitCtx, redisClient, msg.ID)
+			if deliveries > maxStreamDeliveries {
+				deadLetterStreamMessage(submitCtx, redisClient, taskStore, cancellations, msg, deliveries)
+				continue
+			}
+		}
+
+		handleStreamMessage(submitCtx, redisClient, taskStore, cancellations, msg, tasksToCompile)
+	}
+}
+
+func readStreamMessages(
+	ctx context.Context,
+	redisClient *redis.Client,
+	consumer string,
+	messages chan<- redis.XMessage,
+) {
+	for ctx.Err() == nil {
+		streams, err := redisClient.XReadGroup(ctx, &redis.XReadGroupArgs{
+			Group:    taskStreamGroup,
+			Consumer: consumer,
+			Streams:  []string{taskStream, ">"},
+			Count:    streamReadCount,
+			Block:    streamReadBlock,
+		}).Result()
+		if errors.Is(err, redis.Nil) {
+			continue
+		}
+		if err != nil {
+			if ctx.Err() == nil {
+				logging.FromContext(ctx).Error("Error reading task stream", "error", err)
+				sleep(ctx, streamRetryDelay)
+			}
+			continue
+		}
+
+		for _, stream := range streams {
+			for _, msg := range stream.Messages {
+				select {
+				case messages <- msg:
+				case <-ctx.Done():
+					return
+				}
+			}
+		}
+	}
+}
+
+// renewStreamMessages periodically resets the idle time of messages this
+// consumer is still working on, so that other runners don't claim them.
+func renewStreamMessages(
+	ctx context.Context,
+	redisClient *redis.Client,
+	consumer string,
+	interval time.Duration,
+) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		pending, err := redisClient.XPendingExt(ctx, &redis.XPendingExtArgs{
+			Stream:   taskStream,
+			Group:    taskStreamGroup,
+			Start:    "-",
+			End:      "+",
+			Count:    1000,
+			Consumer: consumer,
+		}).Result()
+		if err != nil {
+			logging.FromContext(ctx).Error("Error listing pending task messages", "error", err)
+			continue
+		}
+		if len(pending) == 0 {
+			continue
+		}
+
+		ids := make([]string, 0, len(pending))
+		for _, p := range pending {
+			ids = append(ids, p.ID)
+		}
+		err = redisClient.XClaimJustID(ctx, &redis.XClaimArgs{
+			Stream:   taskStream,
+			Group:    taskStreamGroup,
+			Consumer: consumer,
+			Messages: ids,
+		}).Err()
+		if err != nil {
+			logging.FromContext(ctx).Error("Error renewing pending task messages", "error", err)
+		}
+	}
+}
+
+// claimStreamMessages periodically claims messages left idle by runners that
+// died.
+func claimStreamMessages(
+	ctx context.Context,
+	redisClient *redis.Client,
+	consumer string,
+	claimIdle time.Duration,
+	claimed chan<- redis.XMessage,
+) {
+	ticker := time.NewTicker(claimIdle / 3)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		messages, _, err := redisClient.XAutoClaim(ctx, &redis.XAutoClaimArgs{
+			Stream:   taskStream,
+			Group:    taskStreamGroup,
+			MinIdle:  claimIdle,
+			Start:    "0-0",
+			Count:    streamReadCount,
+			Consumer: consumer,
+		}).Result()
+		if err != nil {
+			logging.FromContext(ctx).Error("Error claiming idle task messages", "error", err)
+			continue
+		}
+
+		for _, msg := range messages {
+			logging.FromContext(ctx).Info("Claimed abandoned task message", "message_id", msg.ID)
+			select {
+			case claimed <- msg:
+			case <-ctx.Done():
+				return
+			}
+		}
+	}
+}
+
+func handleStreamMessage(
+	ctx context.Context,
+	redisClient *redis.Client,
+	taskStore taskstore.Store,
+	cancellations *Cancellations,
+	msg redis.XMessage,
+	tasksToCompile chan model.Task,
+) {
+	payload, _ := msg.Values[taskStreamPayloadField].(string)
+	task, err := parseStartTaskCommand(payload)
+	if err != nil {
+		logging.FromContext(ctx).Error("Error unmarshaling task", "message_id", msg.ID, "error", err)
+		ackStreamMessage(ctx, redisClient, msg.ID)
+		return
+	}
+
+	task.StreamMessageID = msg.ID
+	submitTask(ctx, redisClient, taskStore, cancellations, task, tasksToCompile)
+}
+
+// streamMessageDeliveries returns how often the message has been delivered,
+// or 0 if that can't be told.
+func streamMessageDeliveries(ctx context.Context, redisClient *redis.Client, id string) int64 {
+	pending, err := redisClient.XPendingExt(ctx, &redis.XPendingExtArgs{
+		Stream: taskStream,
+		Group:  taskStreamGroup,
+		Start:  id,
+		End:    id,
+		Count:  1,
+	}).Result()
+	if err != nil {
+		logging.FromContext(ctx).Error("Error getting task message deliveries", "message_id", id, "error", err)
+		return 0
+	}
+	if len(pending) == 0 {
+		return 0
+	}
+	return pending[0].RetryCount
+}
+
+// deadLetterStreamMessage gives up on a message that was delivered too often.
+// It is kept in the dead letter stream for inspection and its task fails.
+func deadLetterStreamMessage(
+	ctx context.Context,
+	redisClient *redis.Client,
+	taskStore taskstore.Store,
+	cancellations *Cancellations,
+	msg redis.XMessage,
+	deliveries int64,
+) {
+	logger := logging.FromContext(ctx)
+	logger.Error("Giving up on task message", "message_id", msg.ID, "deliveries", deliveries)
+
+	err := redisClient.XAdd(ctx, &redis.XAddArgs{
+		Stream: taskDeadLetterStream,
+		Values: map[string]any{
+			taskStreamPayloadField: msg.Values[taskStreamPayloadField],
+			"message_id":           msg.ID,
+			"deliveries":           deliveries,
+		},
+	}).Err()
+	if err != nil {
+		// The message stays pending and is tried again.
+		logger.Error("Error adding task message to dead letter stream", "message_id", msg.ID, "error", err)
+		return
+	}
+
+	payload, _ := msg.Values[taskStreamPayloadField].(string)
+	task, err := parseStartTaskCommand(payload)
+	if err != nil {
+		ackStreamMessage(ctx, redisClient, msg.ID)
+		return
+	}
+	task.StreamMessageID = msg.ID
+	ctx = logging.With(ctx, "task_id", task.ID)
+	failTask(ctx, redisClient, taskStore, cancellations, task, fmt.Errorf("giving up after %d deliveries", deliveries))
+}
+
+func ackStreamMessage(ctx context.Context, redisClient *redis.Client, id string) {
+	err := redisClient.XAck(ctx, taskStream, taskStreamGroup, id).Err()
+	if err != nil {
+		logging.FromContext(ctx).Error("Error acknowledging task message", "message_id", id, "error", err)
+	}
+}
+
+func sleep(ctx context.Context, d time.Duration) {
+	select {
+	case <-ctx.Done():
+	case <-time.After(d):
+	}
+}
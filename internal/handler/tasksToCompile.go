@@ -2,11 +2,20 @@ package handler
 
 import (
 	"context"
+	"errors"
 	"fmt"
+	"strings"
+	"time"
 
+	"github.com/redis/go-redis/v9"
+	"github.com/t3m8ch/coderunner/internal/compiler"
 	"github.com/t3m8ch/coderunner/internal/filesctl"
+	"github.com/t3m8ch/coderunner/internal/logging"
 	"github.com/t3m8ch/coderunner/internal/model"
 	"github.com/t3m8ch/coderunner/internal/sandbox"
+	"github.com/t3m8ch/coderunner/internal/taskstore"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
 )
 
 func HandleTasksToCompile(
@@ -15,9 +24,23 @@ func HandleTasksToCompile(
 	sandboxManager sandbox.Manager,
 	tasksToCompile chan model.Task,
 	tasksToTest chan model.Task,
+	redisClient *redis.Client,
+	taskStore taskstore.Store,
+	cancellations *Cancellations,
+	compilerOutputLimit int,
 ) {
 	for task := range tasksToCompile {
-		handleTaskToCompile(ctx, filesManager, sandboxManager, task, tasksToTest)
+		handleTaskToCompile(
+			ctx,
+			filesManager,
+			sandboxManager,
+			redisClient,
+			taskStore,
+			cancellations,
+			task,
+			tasksToTest,
+			compilerOutputLimit,
+		)
 	}
 }
 
@@ -25,84 +48,193 @@ func handleTaskToCompile(
 	ctx context.Context,
 	filesManager filesctl.Manager,
 	sandboxManager sandbox.Manager,
+	redisClient *redis.Client,
+	taskStore taskstore.Store,
+	cancellations *Cancellations,
 	task model.Task,
 	tasksToTest chan model.Task,
+	compilerOutputLimit int,
 ) {
-	fmt.Printf("Task to compile: %+v\n", task)
+	ctx = logging.With(ctx, "task_id", task.ID, "stage", "compile")
+	logger := logging.FromContext(ctx)
+	logger.Info("Compiling task", "compiler", task.Compiler, "revision", task.Revision)
 
-	codeBinary, err := filesManager.LoadFile(ctx, task.CodeLocation.BucketName, task.CodeLocation.ObjectName)
-	if err != nil {
-		fmt.Printf("Error loading code from file server: %v\n", err)
-		return
-	}
-
-	sandboxID, err := sandboxManager.CreateSandbox(
-		ctx,
-		"gcc:latest",
-		[]string{"g++", sourceFilePath, "-o", compileExecPath, "-static"},
-	)
-	if err != nil {
-		fmt.Printf("Error creating sandbox: %v\n", err)
+	taskCtx := contextForTask(ctx, cancellations, task.ID)
+	if taskCtx.Err() != nil {
+		abortTask(ctx, redisClient, taskStore, cancellations, task)
 		return
 	}
 
-	defer func() {
-		err = sandboxManager.RemoveSandbox(ctx, sandboxID)
+	// A rejudged task is tested with the executable it was compiled to.
+	if location := task.ExecutableLocation; location.ObjectName != "" {
+		exists, err := filesManager.Exists(taskCtx, location.BucketName, location.ObjectName)
 		if err != nil {
-			fmt.Printf("Error sandbox removing: %v\n", err)
+			logger.Error("Error looking up executable", "error", err)
 		}
-	}()
+		if exists {
+			logger.Info("Reusing executable", "object", location.ObjectName)
+			startTesting(ctx, taskStore, task, location, tasksToTest)
+			return
+		}
+	}
 
-	err = sandboxManager.CopyFileToSandbox(ctx, sandboxID, sourceFilePath, 0644, codeBinary)
-	if err != nil {
-		fmt.Printf("Error copying code to sandbox: %v\n", err)
+	task.SetState(model.CompilingTaskState)
+	saveTask(ctx, taskStore, task)
+
+	spec, ok := compiler.Lookup(task.Compiler)
+	if !ok {
+		logger.Error("Unknown compiler", "compiler", task.Compiler)
+		failTask(ctx, redisClient, taskStore, cancellations, task, fmt.Errorf("unknown compiler %q", task.Compiler))
 		return
 	}
 
-	err = sandboxManager.StartSandbox(ctx, sandboxID)
+	codeBinary, err := filesManager.LoadFile(taskCtx, task.CodeLocation.BucketName, task.CodeLocation.ObjectName)
 	if err != nil {
-		fmt.Printf("Error starting sandbox: %v\n", err)
+		logger.Error("Error loading code", "error", err)
+		failTask(ctx, redisClient, taskStore, cancellations, task, fmt.Errorf("loading code: %w", err))
 		return
 	}
 
-	statusCode, err := sandboxManager.WaitSandbox(ctx, sandboxID)
+	files := map[string][]byte{spec.SourceFile: codeBinary}
+	objectName, err := compileCacheObject(taskCtx, sandboxManager, task.Compiler, spec, files)
 	if err != nil {
-		fmt.Printf("Error waiting for sandbox: %v\n", err)
-		return
-	}
-	if statusCode != 0 {
-		fmt.Printf("Compilation failed with exit code %d\n", statusCode)
-		logs, err := sandboxManager.ReadLogsFromSandbox(ctx, sandboxID)
+		// The code can still be compiled, just not cached.
+		logger.Warn("Error computing compile cache key", "error", err)
+		objectName = fmt.Sprintf("%s.out", task.ID)
+	} else {
+		cached, err := filesManager.Exists(taskCtx, execBucketName, objectName)
 		if err != nil {
-			fmt.Printf("Error reading logs from sandbox: %v\n", err)
+			logger.Error("Error looking up compile cache", "error", err)
+		}
+		if cached {
+			logger.Info("Using cached executable", "object", objectName)
+			startTesting(ctx, taskStore, task, model.FileLocation{BucketName: execBucketName, ObjectName: objectName}, tasksToTest)
+			return
 		}
-		fmt.Println(logs)
-		return
 	}
 
-	executable, err := sandboxManager.LoadFileFromSandbox(ctx, sandboxID, compileExecPath)
+	result, err := compile(taskCtx, sandboxManager, spec, files)
 	if err != nil {
-		fmt.Printf("Error copying executable: %v\n", err)
+		logger.Error("Error compiling code", "error", err)
+		failTask(ctx, redisClient, taskStore, cancellations, task, err)
 		return
 	}
+	if result.failed {
+		logger.Info("Compilation failed")
+		logger.Debug("Compiler output", "output", result.output)
 
-	objectName := fmt.Sprintf("%s.out", task.ID)
+		task.Verdict = model.CompilationErrorVerdict
+		task.CompilationOutput = truncateOutput(result.output, compilerOutputLimit)
+		task.SetState(model.CompilationErrorTaskState)
+		publishCompletedTask(ctx, redisClient, taskStore, cancellations, task)
+		return
+	}
 
 	err = filesManager.PutFile(
-		ctx,
+		taskCtx,
 		execBucketName,
 		objectName,
-		executable,
+		result.artifact,
 	)
 	if err != nil {
-		fmt.Printf("Error put object to file server: %v\n", err)
+		logger.Error("Error uploading executable", "error", err)
+		failTask(ctx, redisClient, taskStore, cancellations, task, fmt.Errorf("uploading executable: %w", err))
 		return
 	}
 
-	task.State = model.TestingTaskState
-	task.ExecutableLocation = model.FileLocation{
-		BucketName: execBucketName,
-		ObjectName: objectName,
-	}
+	startTesting(ctx, taskStore, task, model.FileLocation{BucketName: execBucketName, ObjectName: objectName}, tasksToTest)
+}
+
+func startTesting(
+	ctx context.Context,
+	taskStore taskstore.Store,
+	task model.Task,
+	executableLocation model.FileLocation,
+	tasksToTest chan model.Task,
+) {
+	task.ExecutableLocation = executableLocation
+	task.SetState(model.TestingTaskState)
+	saveTask(ctx, taskStore, task)
 	tasksToTest <- task
 }
+
+type compileResult struct {
+	artifact []byte
+	// output holds the compiler output when the compilation failed.
+	output string
+	failed bool
+}
+
+// compile runs the compiler described by spec in a new sandbox. files are
+// copied into the sandbox beforehand and are keyed by their path there.
+func compile(
+	ctx context.Context,
+	sandboxManager sandbox.Manager,
+	spec compiler.Spec,
+	files map[string][]byte,
+) (compileResult, error) {
+	defer func(start time.Time) {
+		compileDuration.Observe(time.Since(start).Seconds())
+	}(time.Now())
+
+	ctx, span := tracer.Start(ctx, "compile", trace.WithAttributes(attribute.String("compiler.image", spec.CompileImage)))
+	defer span.End()
+
+	sandboxID, err := sandboxManager.CreateSandbox(
+		ctx,
+		spec.CompileImage,
+		spec.CompileCmd,
+		compileLimits,
+	)
+	if err != nil {
+		return compileResult{}, fmt.Errorf("creating sandbox: %w", err)
+	}
+	defer removeSandbox(ctx, sandboxManager, sandboxID)
+	logger := logging.FromContext(ctx).With("sandbox_id", sandboxID)
+
+	for path, data := range files {
+		err = sandboxManager.CopyFileToSandbox(ctx, sandboxID, path, 0644, data)
+		if err != nil {
+			return compileResult{}, fmt.Errorf("copying %s to sandbox: %w", path, err)
+		}
+	}
+
+	err = sandboxManager.StartSandbox(ctx, sandboxID)
+	if err != nil {
+		return compileResult{}, fmt.Errorf("starting sandbox: %w", err)
+	}
+
+	result, err := sandboxManager.WaitSandbox(ctx, sandboxID)
+	if err != nil {
+		return compileResult{}, fmt.Errorf("waiting for sandbox: %w", err)
+	}
+	if result.LimitExceeded != sandbox.NoLimitExceeded || result.StatusCode != 0 {
+		logs, err := sandboxManager.ReadLogsFromSandbox(ctx, sandboxID)
+		if err != nil && !errors.Is(err, sandbox.ErrOutputLimitExceeded) {
+			logger.Error("Error reading logs from sandbox", "error", err)
+		}
+		output := logs.Combined()
+		span.SetAttributes(attribute.Bool("compile.failed", true))
+		if result.LimitExceeded != sandbox.NoLimitExceeded {
+			logger.Debug("Compilation exceeded limit", "limit_exceeded", result.LimitExceeded)
+			output += fmt.Sprintf("\ncompilation exceeded %s limit", result.LimitExceeded)
+		} else {
+			logger.Debug("Compiler exited with an error", "exit_code", result.StatusCode)
+		}
+		return compileResult{output: output, failed: true}, nil
+	}
+
+	artifact, err := sandboxManager.LoadFileFromSandbox(ctx, sandboxID, spec.ArtifactPath)
+	if err != nil {
+		return compileResult{}, fmt.Errorf("copying executable: %w", err)
+	}
+
+	return compileResult{artifact: artifact}, nil
+}
+
+func truncateOutput(output string, limit int) string {
+	if limit <= 0 || len(output) <= limit {
+		return output
+	}
+	return strings.ToValidUTF8(output[:limit], "") + "\n... (truncated)"
+}
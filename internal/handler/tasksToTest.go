@@ -3,14 +3,21 @@ package handler
 import (
 	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"io"
+	"slices"
 	"strings"
 	"sync"
+	"time"
 
 	"github.com/redis/go-redis/v9"
+	"github.com/t3m8ch/coderunner/internal/compiler"
 	"github.com/t3m8ch/coderunner/internal/filesctl"
+	"github.com/t3m8ch/coderunner/internal/logging"
 	"github.com/t3m8ch/coderunner/internal/model"
 	"github.com/t3m8ch/coderunner/internal/sandbox"
+	"github.com/t3m8ch/coderunner/internal/taskstore"
 )
 
 func HandleTasksToTest(
@@ -19,9 +26,12 @@ func HandleTasksToTest(
 	sandboxManager sandbox.Manager,
 	tasksToTest chan model.Task,
 	redisClient *redis.Client,
+	taskStore taskstore.Store,
+	cancellations *Cancellations,
+	singleSandbox bool,
 ) {
 	for task := range tasksToTest {
-		handleTaskToTest(ctx, filesManager, sandboxManager, redisClient, task)
+		handleTaskToTest(ctx, filesManager, sandboxManager, redisClient, taskStore, cancellations, task, singleSandbox)
 	}
 }
 
@@ -30,38 +40,105 @@ func handleTaskToTest(
 	filesManager filesctl.Manager,
 	sandboxManager sandbox.Manager,
 	redisClient *redis.Client,
+	taskStore taskstore.Store,
+	cancellations *Cancellations,
 	task model.Task,
+	singleSandbox bool,
 ) {
-	fmt.Printf("Task to test: %+v\n", task)
+	ctx = logging.With(ctx, "task_id", task.ID, "stage", "test")
+	logger := logging.FromContext(ctx)
+	logger.Info("Testing task", "compiler", task.Compiler, "revision", task.Revision)
+
+	taskCtx, span := tracer.Start(contextForTask(ctx, cancellations, task.ID), "testing")
+	defer span.End()
+	if taskCtx.Err() != nil {
+		abortTask(ctx, redisClient, taskStore, cancellations, task)
+		return
+	}
+
+	spec, ok := compiler.Lookup(task.Compiler)
+	if !ok {
+		logger.Error("Unknown compiler", "compiler", task.Compiler)
+		failTask(ctx, redisClient, taskStore, cancellations, task, fmt.Errorf("unknown compiler %q", task.Compiler))
+		return
+	}
 
 	executable, err := filesManager.LoadFile(
-		ctx,
+		taskCtx,
 		task.ExecutableLocation.BucketName,
 		task.ExecutableLocation.ObjectName,
 	)
 	if err != nil {
-		fmt.Printf("Error loading executable from MinIO: %v\n", err)
+		logger.Error("Error loading executable", "error", err)
+		failTask(ctx, redisClient, taskStore, cancellations, task, fmt.Errorf("loading executable: %w", err))
 		return
 	}
-	fmt.Println("Executable loaded")
+	logger.Debug("Executable loaded")
 
 	testsData, err := filesManager.LoadFile(
-		ctx,
+		taskCtx,
 		task.TestsLocation.BucketName,
 		task.TestsLocation.ObjectName,
 	)
 	if err != nil {
-		fmt.Printf("Error loading tests from MinIO: %v\n", err)
+		logger.Error("Error loading tests", "error", err)
+		failTask(ctx, redisClient, taskStore, cancellations, task, fmt.Errorf("loading tests: %w", err))
 		return
 	}
-	fmt.Println("Tests loaded")
+	logger.Debug("Tests loaded")
 
-	tests, err := model.ParseTestsJSON(testsData)
+	suite, err := model.ParseTestsJSON(testsData)
 	if err != nil {
-		fmt.Printf("Error parsing tests JSON: %v\n", err)
+		logger.Error("Error parsing tests", "error", err)
+		failTask(ctx, redisClient, taskStore, cancellations, task, fmt.Errorf("parsing tests: %w", err))
 		return
 	}
-	fmt.Println("Tests parsed")
+	logger.Debug("Tests parsed")
+
+	var testChecker *judgeProgram
+	if suite.Checker != nil {
+		testChecker, err = prepareJudgeProgram(taskCtx, filesManager, sandboxManager, "checker", *suite.Checker)
+		if err != nil {
+			logger.Error("Error preparing checker", "error", err)
+			failTask(ctx, redisClient, taskStore, cancellations, task, err)
+			return
+		}
+		logger.Debug("Checker compiled")
+	}
+
+	var interactor *judgeProgram
+	if suite.Interactor != nil {
+		interactor, err = prepareJudgeProgram(taskCtx, filesManager, sandboxManager, "interactor", *suite.Interactor)
+		if err != nil {
+			logger.Error("Error preparing interactor", "error", err)
+			failTask(ctx, redisClient, taskStore, cancellations, task, err)
+			return
+		}
+		logger.Debug("Interactor compiled")
+	}
+
+	tests := suite.Tests
+	limits := testLimits(suite.Limits)
+
+	comparators := make([]comparator, len(tests))
+	testsLimits := make([]sandbox.Limits, len(tests))
+	for i, test := range tests {
+		testsLimits[i] = limits
+		if test.OutputLimitKb > 0 {
+			testsLimits[i].Output = test.OutputLimitKb << 10
+		}
+
+		dto := suite.Comparator
+		if test.Comparator != nil {
+			dto = test.Comparator
+		}
+		comparators[i], err = newComparator(dto)
+		if err != nil {
+			logger.Error("Error in comparator", "test_id", i, "error", err)
+			failTask(ctx, redisClient, taskStore, cancellations, task, fmt.Errorf("test #%d: %w", i, err))
+			return
+		}
+	}
 
 	var wg sync.WaitGroup
 	wg.Add(len(tests))
@@ -80,110 +157,316 @@ func handleTaskToTest(
 	}()
 
 	go func() {
-		fmt.Println("Waiting...")
 		wg.Wait()
-		fmt.Println("Done! Closing testsResultsCh and testsCh")
 		close(testsResultsCh)
 		close(testsCh)
 	}()
 
+	if singleSandbox && interactor == nil {
+		// The tests run one after another, each in the sandbox of the
+		// previous one.
+		shared := &sharedSandbox{manager: sandboxManager, spec: spec, executable: executable}
+		for test := range testsCh {
+			testCtx, testSpan := startTestSpan(logging.With(taskCtx, "test_id", test.ID), test)
+			start := time.Now()
+			result := runSharedTest(testCtx, shared, testsLimits[test.ID], testChecker, comparators[test.ID], task.ID, test)
+			finishTestSpan(testSpan, result)
+			testsResultsCh <- observeTest(start, result)
+			wg.Done()
+		}
+		shared.remove(taskCtx)
+	}
+
 	for test := range testsCh {
 		go func() {
 			defer wg.Done()
+			testCtx, testSpan := startTestSpan(logging.With(taskCtx, "test_id", test.ID), test)
+			start := time.Now()
+			var result model.TestResult
+			if interactor != nil {
+				result = runInteractiveTest(testCtx, sandboxManager, spec, testsLimits[test.ID], executable, interactor, testChecker, task.ID, test)
+			} else {
+				result = runTest(testCtx, sandboxManager, spec, testsLimits[test.ID], executable, testChecker, comparators[test.ID], task.ID, test)
+			}
+			finishTestSpan(testSpan, result)
+			testsResultsCh <- observeTest(start, result)
+		}()
+	}
 
-			fmt.Printf("----- Test #%d ----- \n", test.ID)
+	task.TestsResults = make([]model.TestResult, 0, len(tests))
+	for test := range testsResultsCh {
+		// Results of tests interrupted by cancellation are meaningless.
+		if taskCtx.Err() != nil {
+			continue
+		}
 
-			sandboxID, err := sandboxManager.CreateSandbox(
-				ctx,
-				"debian:bookworm",
-				[]string{"sh", "-c", fmt.Sprintf("%s < %s", testingExecPath, inputFilePath)},
-			)
-			if err != nil {
-				fmt.Printf("test #%d: Error creating sandbox: %v\n", test.ID, err)
-				return
-			}
-			fmt.Printf("test #%d: Sandbox created\n", test.ID)
+		task.TestsResults = append(task.TestsResults, test)
+		task.UpdatedAt = time.Now().UTC()
+		saveTask(ctx, taskStore, task)
 
-			err = sandboxManager.CopyFileToSandbox(ctx, sandboxID, testingExecPath, 0700, executable)
-			if err != nil {
-				fmt.Printf("test #%d: Error copying executable to sandbox: %v\n", test.ID, err)
-				return
-			}
-			fmt.Printf("test #%d: Executable copied to sandbox\n", test.ID)
+		jsonBytes, err := json.Marshal(test)
+		if err != nil {
+			logger.Error("Error marshaling test result", "test_id", test.TestID, "error", err)
+		}
+		redisClient.Publish(ctx, completedTestsChannel, string(jsonBytes))
+	}
 
-			err = sandboxManager.CopyFileToSandbox(ctx, sandboxID, inputFilePath, 0644, []byte(test.Stdin))
-			if err != nil {
-				fmt.Printf("test #%d: Error copying input data: %v\n", test.ID, err)
-				return
-			}
+	slices.SortFunc(task.TestsResults, func(a, b model.TestResult) int {
+		return a.TestID - b.TestID
+	})
+	if taskCtx.Err() != nil {
+		abortTask(ctx, redisClient, taskStore, cancellations, task)
+		return
+	}
 
-			err = sandboxManager.StartSandbox(ctx, sandboxID)
-			if err != nil {
-				fmt.Printf("test #%d: Error starting sandbox: %v\n", test.ID, err)
-				return
-			}
-			fmt.Printf("test #%d: Sandbox started\n", test.ID)
+	task.Verdict = model.TaskVerdict(task.TestsResults)
+	task.SetState(model.CompletedTaskState)
 
-			statusCode, err := sandboxManager.WaitSandbox(ctx, sandboxID)
-			if err != nil {
-				fmt.Printf("test #%d: Error waiting for sandbox: %v\n", test.ID, err)
-				return
-			}
+	logger.Info("All tests completed", "verdict", task.Verdict)
 
-			output, err := sandboxManager.ReadLogsFromSandbox(ctx, sandboxID)
-			if err != nil {
-				fmt.Printf("test #%d: Error reading logs from sandbox: %v\n", test.ID, err)
-				return
-			}
-			fmt.Printf("test #%d: Output read from sandbox\n", test.ID)
-			fmt.Printf("test #%d: %s", test.ID, output)
+	publishCompletedTask(ctx, redisClient, taskStore, cancellations, task)
+}
 
-			fmt.Printf("test #%d: Testing completed with exit code %d\n", test.ID, statusCode)
+func runTest(
+	ctx context.Context,
+	sandboxManager sandbox.Manager,
+	spec compiler.Spec,
+	limits sandbox.Limits,
+	executable []byte,
+	testChecker *judgeProgram,
+	compare comparator,
+	taskID string,
+	test model.Test,
+) model.TestResult {
+	logger := logging.FromContext(ctx)
+	logger.Debug("Running test")
 
-			output = strings.Trim(output, " ")
-			output = strings.Trim(output, "\n")
-			output = strings.Trim(output, "\t")
+	sandboxID, attachment, err := createAttachedSandbox(
+		ctx,
+		sandboxManager,
+		spec.RunImage,
+		spec.RunCmd,
+		limits,
+		[]sandboxFile{{spec.ExecutablePath, 0555, executable}},
+	)
+	if sandboxID != "" {
+		defer removeSandbox(ctx, sandboxManager, sandboxID)
+	}
+	defer attachment.Close()
+	if err != nil {
+		logger.Error("Error preparing sandbox", "error", err)
+		return internalErrorResult(taskID, test)
+	}
+	logger.Debug("Sandbox created", "sandbox_id", sandboxID)
 
-			test.Stdout = strings.Trim(output, " ")
-			test.Stdout = strings.Trim(output, "\n")
-			test.Stdout = strings.Trim(output, "\t")
+	return executeTest(ctx, sandboxManager, sandboxID, attachment, limits, testChecker, compare, taskID, test)
+}
 
-			if statusCode == 0 && output == test.Stdout {
-				fmt.Printf("test #%d: Test passed\n", test.ID)
-				testsResultsCh <- model.TestResult{TaskID: task.ID, TestID: test.ID, Successful: true}
-			} else {
-				testsResultsCh <- model.TestResult{TaskID: task.ID, TestID: test.ID, Successful: false}
-				fmt.Printf("test #%d: Test failed\n", test.ID)
-				fmt.Printf("test #%d: Expected: %s\n", test.ID, test.Stdout)
-				fmt.Printf("test #%d: Actual: %s\n", test.ID, output)
-				fmt.Printf("test #%d: Expected bytes: %q\n", test.ID, []byte(test.Stdout))
-				fmt.Printf("test #%d: Actual bytes:   %q\n", test.ID, []byte(output))
-			}
+// runSharedTest runs the test like runTest, but in the shared sandbox.
+func runSharedTest(
+	ctx context.Context,
+	shared *sharedSandbox,
+	limits sandbox.Limits,
+	testChecker *judgeProgram,
+	compare comparator,
+	taskID string,
+	test model.Test,
+) model.TestResult {
+	logger := logging.FromContext(ctx)
+	logger.Debug("Running test")
+
+	sandboxID, attachment, err := shared.attach(ctx, limits)
+	defer attachment.Close()
+	if err != nil {
+		logger.Error("Error preparing sandbox", "error", err)
+		return internalErrorResult(taskID, test)
+	}
+
+	return executeTest(ctx, shared.manager, sandboxID, attachment, limits, testChecker, compare, taskID, test)
+}
+
+func internalErrorResult(taskID string, test model.Test) model.TestResult {
+	return model.TestResult{
+		TaskID:  taskID,
+		TestID:  test.ID,
+		Verdict: model.InternalErrorVerdict,
+	}
+}
+
+// executeTest starts the prepared sandbox, feeds it the test input and judges
+// its output.
+func executeTest(
+	ctx context.Context,
+	sandboxManager sandbox.Manager,
+	sandboxID sandbox.SandboxID,
+	attachment *sandbox.Attachment,
+	limits sandbox.Limits,
+	testChecker *judgeProgram,
+	compare comparator,
+	taskID string,
+	test model.Test,
+) model.TestResult {
+	testResult := internalErrorResult(taskID, test)
+	logger := logging.FromContext(ctx).With("sandbox_id", sandboxID)
+
+	err := sandboxManager.StartSandbox(ctx, sandboxID)
+	if err != nil {
+		logger.Error("Error starting sandbox", "error", err)
+		return testResult
+	}
+	logger.Debug("Sandbox started")
+
+	var (
+		wg             sync.WaitGroup
+		output         string
+		outputExceeded bool
+		stderr         string
+	)
+	stdinDone := make(chan struct{})
+	go func() {
+		defer close(stdinDone)
+		io.Copy(attachment.Stdin, strings.NewReader(test.Stdin))
+		attachment.Stdin.Close()
+	}()
+	// The program may exit without reading all of its input, which leaves
+	// the write blocked until the attachment is closed.
+	defer func() {
+		attachment.Close()
+		<-stdinDone
+	}()
+
+	wg.Add(2)
+	go func() {
+		defer wg.Done()
+		output, outputExceeded = readStream(attachment.Stdout, limits.Output)
+	}()
+	go func() {
+		defer wg.Done()
+		stderr, _ = readStream(attachment.Stderr, stderrLimit)
+	}()
+
+	result, err := sandboxManager.WaitSandbox(ctx, sandboxID)
+	if err != nil {
+		// The streams only end once the sandbox exits.
+		attachment.Close()
+		wg.Wait()
+		logger.Error("Error waiting for sandbox", "error", err)
+		return testResult
+	}
+	wg.Wait()
+	if outputExceeded && result.LimitExceeded == sandbox.NoLimitExceeded {
+		result.LimitExceeded = sandbox.OutputLimitExceeded
+	}
+
+	logger.Debug(
+		"Program completed",
+		"exit_code", result.StatusCode,
+		"limit_exceeded", result.LimitExceeded,
+		"wall_time", result.WallTime,
+	)
 
-			err = sandboxManager.RemoveSandbox(ctx, sandboxID)
+	testResult.ExitCode = result.StatusCode
+	testResult.Signal = result.Signal
+	testResult.WallTimeMs = result.WallTime.Milliseconds()
+	testResult.CPUTimeMs = result.CPUTime.Milliseconds()
+	testResult.PeakMemoryBytes = result.PeakMemory
+	testResult.Stderr = strings.ToValidUTF8(stderr, "")
+	testResult.Verdict = testVerdict(result)
+	if testResult.Verdict == model.OKVerdict {
+		if testChecker != nil {
+			testResult.Verdict, testResult.Comment, err = testChecker.check(ctx, sandboxManager, test, output)
 			if err != nil {
-				fmt.Printf("test #%d: Error sandbox removing: %v\n", test.ID, err)
+				logger.Error("Error running checker", "error", err)
+				testResult.Verdict = model.InternalErrorVerdict
+				testResult.Comment = strings.TrimSpace(err.Error() + "\n" + testResult.Comment)
 			}
-			fmt.Printf("test #%d: Sandbox removed\n", test.ID)
-		}()
+		} else if !compare(test.Stdout, output) {
+			testResult.Verdict = model.WrongAnswerVerdict
+		}
 	}
+	testResult.Successful = testResult.Verdict == model.OKVerdict
 
-	task.TestsResults = make([]model.TestResult, 0, len(tests))
-	for test := range testsResultsCh {
-		task.TestsResults = append(task.TestsResults, test)
-		jsonBytes, err := json.Marshal(test)
-		if err != nil {
-			fmt.Printf("test #%d: Error marshaling test result: %v\n", test.TestID, err)
+	if testResult.Successful {
+		logger.Debug("Test passed")
+	} else {
+		logger.Debug(
+			"Test failed",
+			"verdict", testResult.Verdict,
+			"expected", test.Stdout,
+			"actual", output,
+		)
+	}
+
+	return testResult
+}
+
+// testVerdict judges how the program ran, OKVerdict means that its output
+// has to be checked.
+func testVerdict(result sandbox.WaitResult) model.Verdict {
+	switch result.LimitExceeded {
+	case sandbox.WallTimeLimitExceeded, sandbox.CPUTimeLimitExceeded:
+		return model.TimeLimitExceededVerdict
+	case sandbox.MemoryLimitExceeded:
+		return model.MemoryLimitExceededVerdict
+	case sandbox.OutputLimitExceeded:
+		return model.OutputLimitExceededVerdict
+	}
+
+	if result.StatusCode != 0 {
+		return model.RuntimeErrorVerdict
+	}
+	return model.OKVerdict
+}
+
+// sharedSandbox runs the tests of a task in one sandbox, restarting it with a
+// fresh work dir between them, so that the executable is only copied once.
+// A new sandbox is created whenever the limits change or the manager can't
+// restart the old one, e.g. because it was killed for exceeding a limit.
+type sharedSandbox struct {
+	manager    sandbox.Manager
+	spec       compiler.Spec
+	executable []byte
+
+	id     sandbox.SandboxID
+	limits sandbox.Limits
+}
+
+// attach prepares the sandbox for the next test and attaches to it.
+func (s *sharedSandbox) attach(ctx context.Context, limits sandbox.Limits) (sandbox.SandboxID, *sandbox.Attachment, error) {
+	if s.id != "" && s.limits == limits {
+		var attachment *sandbox.Attachment
+		err := s.manager.RestartSandbox(ctx, s.id, []string{s.spec.ExecutablePath})
+		if err == nil {
+			attachment, err = s.manager.AttachToSandbox(ctx, s.id)
+			if err == nil {
+				return s.id, attachment, nil
+			}
+		}
+		if !errors.Is(err, sandbox.ErrRestartNotSupported) {
+			logging.FromContext(ctx).Warn("Can't reuse sandbox", "sandbox_id", s.id, "error", err)
 		}
-		redisClient.Publish(ctx, completedTestsChannel, string(jsonBytes))
 	}
 
-	fmt.Println("All tests completed!")
-	fmt.Println(task.TestsResults)
+	s.remove(ctx)
+	id, attachment, err := createAttachedSandbox(
+		ctx,
+		s.manager,
+		s.spec.RunImage,
+		s.spec.RunCmd,
+		limits,
+		[]sandboxFile{{s.spec.ExecutablePath, 0555, s.executable}},
+	)
+	s.id, s.limits = id, limits
+	if err == nil {
+		logging.FromContext(ctx).Debug("Sandbox created", "sandbox_id", id)
+	}
+	return id, attachment, err
+}
 
-	jsonBytes, err := json.Marshal(task)
-	if err != nil {
-		fmt.Printf("Error marshaling task: %v\n", err)
+func (s *sharedSandbox) remove(ctx context.Context) {
+	if s.id == "" {
+		return
 	}
-	redisClient.Publish(ctx, completedTasksChannel, string(jsonBytes))
+	removeSandbox(ctx, s.manager, s.id)
+	s.id = ""
 }
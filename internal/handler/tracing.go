@@ -0,0 +1,54 @@
+package handler
+
+import (
+	"context"
+
+	"github.com/t3m8ch/coderunner/internal/model"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/trace"
+)
+
+var tracer = otel.Tracer("github.com/t3m8ch/coderunner/internal/handler")
+
+// startTaskSpan starts the span covering a task from intake to publication of
+// its result. It continues the trace of the task command if there is one, or
+// else the trace of ctx, e.g. of an API request.
+func startTaskSpan(ctx context.Context, task model.Task) (context.Context, trace.Span) {
+	if len(task.TraceContext) > 0 {
+		ctx = otel.GetTextMapPropagator().Extract(ctx, propagation.MapCarrier(task.TraceContext))
+	}
+	return tracer.Start(ctx, "task",
+		trace.WithSpanKind(trace.SpanKindConsumer),
+		trace.WithAttributes(
+			attribute.String("task.id", task.ID),
+			attribute.String("task.compiler", task.Compiler),
+			attribute.Int("task.revision", task.Revision),
+		),
+	)
+}
+
+// recordTaskOutcome sets the final state of a task on its span.
+func recordTaskOutcome(span trace.Span, task model.Task) {
+	span.SetAttributes(
+		attribute.String("task.state", task.State),
+		attribute.String("task.verdict", string(task.Verdict)),
+	)
+	if task.State == model.FailedTaskState {
+		span.SetStatus(codes.Error, task.Error)
+	}
+}
+
+func startTestSpan(ctx context.Context, test model.Test) (context.Context, trace.Span) {
+	return tracer.Start(ctx, "test", trace.WithAttributes(attribute.Int("test.id", test.ID)))
+}
+
+func finishTestSpan(span trace.Span, result model.TestResult) {
+	span.SetAttributes(attribute.String("test.verdict", string(result.Verdict)))
+	if result.Verdict == model.InternalErrorVerdict {
+		span.SetStatus(codes.Error, result.Comment)
+	}
+	span.End()
+}
@@ -0,0 +1,53 @@
+// Package logging carries a structured logger through contexts, so that the
+// attributes of a task, test or sandbox end up on every line logged for it.
+package logging
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log/slog"
+	"strings"
+)
+
+type loggerKey struct{}
+
+// New returns a logger writing at the given level ("debug", "info", "warn"
+// or "error") in the given format ("text" or "json").
+func New(w io.Writer, level string, format string) (*slog.Logger, error) {
+	var lvl slog.Level
+	if level != "" {
+		err := lvl.UnmarshalText([]byte(level))
+		if err != nil {
+			return nil, fmt.Errorf("log level: %w", err)
+		}
+	}
+
+	options := &slog.HandlerOptions{Level: lvl}
+	switch strings.ToLower(format) {
+	case "", "text":
+		return slog.New(slog.NewTextHandler(w, options)), nil
+	case "json":
+		return slog.New(slog.NewJSONHandler(w, options)), nil
+	default:
+		return nil, fmt.Errorf("unknown log format %q", format)
+	}
+}
+
+// WithLogger returns a context carrying the logger.
+func WithLogger(ctx context.Context, logger *slog.Logger) context.Context {
+	return context.WithValue(ctx, loggerKey{}, logger)
+}
+
+// FromContext returns the logger of the context, or the default one.
+func FromContext(ctx context.Context) *slog.Logger {
+	if logger, ok := ctx.Value(loggerKey{}).(*slog.Logger); ok {
+		return logger
+	}
+	return slog.Default()
+}
+
+// With returns a context whose logger adds the given attributes.
+func With(ctx context.Context, args ...any) context.Context {
+	return WithLogger(ctx, FromContext(ctx).With(args...))
+}
@@ -1,9 +1,15 @@
 package model
 
+import "time"
+
 const (
-	CompilingTaskState = "compiling"
-	TestingTaskState   = "testing"
-	CompletedTaskState = "completed"
+	QueuedTaskState           = "queued"
+	CompilingTaskState        = "compiling"
+	TestingTaskState          = "testing"
+	CompletedTaskState        = "completed"
+	CompilationErrorTaskState = "compilation_error"
+	FailedTaskState           = "failed"
+	CancelledTaskState        = "cancelled"
 )
 
 type StartTaskCommand struct {
@@ -11,14 +17,104 @@ type StartTaskCommand struct {
 	CodeLocation  FileLocation `json:"codeLocation"`
 	TestsLocation FileLocation `json:"testsLocation"`
 	Compiler      string       `json:"compiler"`
+	// TraceContext holds the W3C trace context fields, e.g. "traceparent",
+	// of the request the task comes from, so that its trace continues into
+	// the runner.
+	TraceContext map[string]string `json:"traceContext,omitempty"`
+}
+
+type CancelTaskCommand struct {
+	ID string `json:"id"`
+}
+
+// RejudgeTaskCommand reruns the testing of finished tasks against the current
+// tests. The tasks are selected by ID, by a list of IDs, by the tests file
+// they were tested against, or by any combination of these.
+type RejudgeTaskCommand struct {
+	ID            string        `json:"id,omitempty"`
+	IDs           []string      `json:"ids,omitempty"`
+	TestsLocation *FileLocation `json:"testsLocation,omitempty"`
+}
+
+// TaskRevision is the result of a task before it was rejudged.
+type TaskRevision struct {
+	Revision          int          `json:"revision"`
+	State             string       `json:"state"`
+	Verdict           Verdict      `json:"verdict,omitempty"`
+	TestsResults      []TestResult `json:"testsResults"`
+	CompilationOutput string       `json:"compilationOutput,omitempty"`
+	Error             string       `json:"error,omitempty"`
+	FinishedAt        time.Time    `json:"finishedAt"`
+}
+
+type StateChange struct {
+	State string    `json:"state"`
+	At    time.Time `json:"at"`
 }
 
 type Task struct {
-	ID                 string       `json:"id"`
-	CodeLocation       FileLocation `json:"codeLocation"`
-	TestsLocation      FileLocation `json:"testsLocation"`
-	ExecutableLocation FileLocation `json:"executableLocation"`
-	Compiler           string       `json:"compiler"`
-	State              string       `json:"state"`
-	TestsResults       []TestResult `json:"testsResults"`
+	ID                 string        `json:"id"`
+	CodeLocation       FileLocation  `json:"codeLocation"`
+	TestsLocation      FileLocation  `json:"testsLocation"`
+	ExecutableLocation FileLocation  `json:"executableLocation"`
+	Compiler           string        `json:"compiler"`
+	State              string        `json:"state"`
+	TestsResults       []TestResult  `json:"testsResults"`
+	Verdict            Verdict       `json:"verdict,omitempty"`
+	CompilationOutput  string        `json:"compilationOutput,omitempty"`
+	Error              string        `json:"error,omitempty"`
+	CreatedAt          time.Time     `json:"createdAt"`
+	UpdatedAt          time.Time     `json:"updatedAt"`
+	History            []StateChange `json:"history"`
+	// Revision counts how many times the task was rejudged, the results of
+	// earlier revisions are kept in Revisions.
+	Revision  int            `json:"revision"`
+	Revisions []TaskRevision `json:"revisions,omitempty"`
+
+	// StreamMessageID is set for tasks received from the tasks stream and is
+	// acknowledged once the task result is published.
+	StreamMessageID string `json:"-"`
+	// TraceContext is the trace context of the command the task came with.
+	// Rejudged tasks start a new trace instead.
+	TraceContext map[string]string `json:"-"`
+}
+
+// SetState moves the task to the given state and records the transition.
+func (t *Task) SetState(state string) {
+	now := time.Now().UTC()
+	if t.CreatedAt.IsZero() {
+		t.CreatedAt = now
+	}
+	t.State = state
+	t.UpdatedAt = now
+	t.History = append(t.History, StateChange{State: state, At: now})
+}
+
+// Rejudge archives the current result as a revision and resets the task to
+// be tested again.
+func (t *Task) Rejudge() {
+	t.Revisions = append(t.Revisions, TaskRevision{
+		Revision:          t.Revision,
+		State:             t.State,
+		Verdict:           t.Verdict,
+		TestsResults:      t.TestsResults,
+		CompilationOutput: t.CompilationOutput,
+		Error:             t.Error,
+		FinishedAt:        t.UpdatedAt,
+	})
+	t.Revision++
+	t.TestsResults = nil
+	t.Verdict = ""
+	t.CompilationOutput = ""
+	t.Error = ""
+}
+
+// Finished reports whether the task has reached a final state.
+func (t *Task) Finished() bool {
+	switch t.State {
+	case CompletedTaskState, CompilationErrorTaskState, FailedTaskState, CancelledTaskState:
+		return true
+	default:
+		return false
+	}
 }
@@ -1,10 +1,71 @@
 package model
 
-import "encoding/json"
+import (
+	"bytes"
+	"encoding/json"
+)
 
 type TestDTO struct {
 	Stdin  string `json:"stdin"`
 	Stdout string `json:"stdout"`
+	// Comparator overrides the comparator of the suite for this test.
+	Comparator *ComparatorDTO `json:"comparator,omitempty"`
+	// OutputLimitKb overrides the output limit of the suite for this test,
+	// e.g. for a test with a big expected output.
+	OutputLimitKb int64 `json:"outputLimitKb,omitempty"`
+}
+
+// ComparatorDTO selects how the output is compared with the expected stdout
+// when there is no checker. It may also be given as a plain mode string.
+type ComparatorDTO struct {
+	Mode       string  `json:"mode"`
+	AbsEpsilon float64 `json:"absEpsilon,omitempty"`
+	RelEpsilon float64 `json:"relEpsilon,omitempty"`
+}
+
+func (c *ComparatorDTO) UnmarshalJSON(data []byte) error {
+	if bytes.HasPrefix(bytes.TrimSpace(data), []byte(`"`)) {
+		return json.Unmarshal(data, &c.Mode)
+	}
+
+	type comparatorDTO ComparatorDTO
+	return json.Unmarshal(data, (*comparatorDTO)(c))
+}
+
+// Limits are set by problem setters in the tests file. Zero values fall back
+// to the runner's defaults.
+type Limits struct {
+	CPUTimeLimitMs  int64 `json:"cpuTimeLimitMs"`
+	WallTimeLimitMs int64 `json:"wallTimeLimitMs"`
+	MemoryLimitMb   int64 `json:"memoryLimitMb"`
+	PidsLimit       int64 `json:"pidsLimit"`
+	OutputLimitKb   int64 `json:"outputLimitKb"`
+}
+
+// JudgeProgramDTO describes a testlib-style checker or interactor, which
+// reports the verdict with its exit code. A checker is run as
+// `checker input output answer`, an interactor as
+// `interactor input output answer` with its stdio connected to the solution.
+// The source is given either inline or as a location. Files are copied next
+// to the source before compiling, e.g. {"testlib.h": {...}}.
+type JudgeProgramDTO struct {
+	Compiler       string                  `json:"compiler"`
+	Source         string                  `json:"source"`
+	SourceLocation *FileLocation           `json:"sourceLocation"`
+	Files          map[string]FileLocation `json:"files"`
+}
+
+// TestSuiteDTO is the contents of a tests file. A plain JSON array of tests is
+// accepted as well and yields a suite with default limits. With an
+// interactor, the tests are interactive and the interactor decides the
+// verdict. Otherwise the output is checked by the checker, or compared with
+// the expected stdout by the comparator when there is no checker.
+type TestSuiteDTO struct {
+	Limits     Limits           `json:"limits"`
+	Interactor *JudgeProgramDTO `json:"interactor"`
+	Checker    *JudgeProgramDTO `json:"checker"`
+	Comparator *ComparatorDTO   `json:"comparator"`
+	Tests      []TestDTO        `json:"tests"`
 }
 
 type Test struct {
@@ -14,13 +75,27 @@ type Test struct {
 }
 
 type TestResult struct {
-	TaskID     string `json:"task_id"`
-	TestID     int    `json:"test_id"`
-	Successful bool   `json:"successful"`
+	TaskID          string  `json:"task_id"`
+	TestID          int     `json:"test_id"`
+	Successful      bool    `json:"successful"`
+	Verdict         Verdict `json:"verdict"`
+	ExitCode        int64   `json:"exit_code"`
+	Signal          int     `json:"signal,omitempty"`
+	WallTimeMs      int64   `json:"wall_time_ms"`
+	CPUTimeMs       int64   `json:"cpu_time_ms"`
+	PeakMemoryBytes int64   `json:"peak_memory_bytes"`
+	// Stderr is the truncated stderr of the solution, it isn't checked.
+	Stderr string `json:"stderr,omitempty"`
+	// Comment is the message of the checker.
+	Comment string `json:"comment,omitempty"`
 }
 
-func ParseTestsJSON(data []byte) ([]TestDTO, error) {
-	var tests []TestDTO
-	err := json.Unmarshal(data, &tests)
-	return tests, err
+func ParseTestsJSON(data []byte) (TestSuiteDTO, error) {
+	var suite TestSuiteDTO
+	if bytes.HasPrefix(bytes.TrimSpace(data), []byte("[")) {
+		err := json.Unmarshal(data, &suite.Tests)
+		return suite, err
+	}
+	err := json.Unmarshal(data, &suite)
+	return suite, err
 }
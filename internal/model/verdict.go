@@ -0,0 +1,26 @@
+package model
+
+type Verdict = string
+
+const (
+	OKVerdict                  Verdict = "ok"
+	WrongAnswerVerdict         Verdict = "wrong_answer"
+	PresentationErrorVerdict   Verdict = "presentation_error"
+	TimeLimitExceededVerdict   Verdict = "time_limit_exceeded"
+	MemoryLimitExceededVerdict Verdict = "memory_limit_exceeded"
+	OutputLimitExceededVerdict Verdict = "output_limit_exceeded"
+	RuntimeErrorVerdict        Verdict = "runtime_error"
+	CompilationErrorVerdict    Verdict = "compilation_error"
+	InternalErrorVerdict       Verdict = "internal_error"
+)
+
+// TaskVerdict returns the verdict of the first failed test in the given order,
+// or OKVerdict if all tests passed.
+func TaskVerdict(results []TestResult) Verdict {
+	for _, result := range results {
+		if result.Verdict != OKVerdict {
+			return result.Verdict
+		}
+	}
+	return OKVerdict
+}
@@ -2,19 +2,37 @@ package sandbox
 
 import (
 	"context"
-	"io"
+	"errors"
 )
 
 type SandboxID = string
 type StatusCode = int64
 
 type Manager interface {
-	CreateSandbox(ctx context.Context, image string, cmd []string) (SandboxID, error)
+	CreateSandbox(ctx context.Context, image string, cmd []string, limits Limits) (SandboxID, error)
 	StartSandbox(ctx context.Context, id SandboxID) error
-	AttachToSandbox(ctx context.Context, id SandboxID) (io.Reader, io.WriteCloser, error)
+	// RestartSandbox prepares a sandbox whose command has exited to run it
+	// again with a fresh work dir, keeping only the files at the keep paths.
+	// It returns ErrRestartNotSupported or another error when the sandbox
+	// can't be reused, in which case a new one has to be created.
+	RestartSandbox(ctx context.Context, id SandboxID, keep []string) error
+	AttachToSandbox(ctx context.Context, id SandboxID) (*Attachment, error)
 	RemoveSandbox(ctx context.Context, id SandboxID) error
 	CopyFileToSandbox(ctx context.Context, id SandboxID, path string, mode int64, data []byte) error
 	LoadFileFromSandbox(ctx context.Context, id SandboxID, path string) ([]byte, error)
-	WaitSandbox(ctx context.Context, id SandboxID) (StatusCode, error)
-	ReadLogsFromSandbox(ctx context.Context, id SandboxID) (string, error)
+	WaitSandbox(ctx context.Context, id SandboxID) (WaitResult, error)
+	ReadLogsFromSandbox(ctx context.Context, id SandboxID) (Logs, error)
+	// ImageDigest returns the ID of the local image, which changes whenever
+	// the tag is pulled again with new contents.
+	ImageDigest(ctx context.Context, image string) (string, error)
 }
+
+var ErrRestartNotSupported = errors.New("restarting sandboxes is not supported")
+
+// WorkDir is where the files of a sandbox go and where its code may write.
+// It lives on a mount at workVolume rather than being the mount itself, so
+// that its owner and mode can be set along with the files copied into it.
+const (
+	WorkDir    = workVolume + "/app"
+	workVolume = "/sandbox"
+)
@@ -0,0 +1,60 @@
+package sandbox
+
+import (
+	"io"
+
+	"github.com/docker/docker/api/types"
+	"github.com/docker/docker/pkg/stdcopy"
+)
+
+// Attachment holds the standard streams of a sandbox. Attach before starting
+// the sandbox to get all of its output. Stdout and Stderr must both be read
+// until EOF, otherwise the other one stalls. Closing Stdin sends EOF to the
+// sandboxed process.
+type Attachment struct {
+	Stdin  io.WriteCloser
+	Stdout io.Reader
+	Stderr io.Reader
+
+	close func()
+}
+
+// Close releases the streams.
+func (a *Attachment) Close() {
+	if a != nil && a.close != nil {
+		a.close()
+	}
+}
+
+func newHijackedAttachment(resp types.HijackedResponse) *Attachment {
+	stdoutReader, stdoutWriter := io.Pipe()
+	stderrReader, stderrWriter := io.Pipe()
+	go func() {
+		_, err := stdcopy.StdCopy(stdoutWriter, stderrWriter, resp.Reader)
+		stdoutWriter.CloseWithError(err)
+		stderrWriter.CloseWithError(err)
+	}()
+
+	return &Attachment{
+		Stdin:  hijackedStdin{resp: resp},
+		Stdout: stdoutReader,
+		Stderr: stderrReader,
+		close: func() {
+			resp.Close()
+			stdoutReader.Close()
+			stderrReader.Close()
+		},
+	}
+}
+
+type hijackedStdin struct {
+	resp types.HijackedResponse
+}
+
+func (s hijackedStdin) Write(p []byte) (int, error) {
+	return s.resp.Conn.Write(p)
+}
+
+func (s hijackedStdin) Close() error {
+	return s.resp.CloseWrite()
+}
@@ -7,20 +7,50 @@ import (
 	"encoding/binary"
 	"fmt"
 	"io"
+	"path/filepath"
+	"sync"
+	"time"
 
 	"github.com/docker/docker/api/types/container"
 	docker "github.com/docker/docker/client"
+	"github.com/docker/docker/pkg/stdcopy"
 )
 
 type DockerManager struct {
 	dockerClient *docker.Client
+	instanceID   string
+	security     SecurityConfig
+
+	mu        sync.Mutex
+	sandboxes map[SandboxID]dockerSandbox
+}
+
+type dockerSandbox struct {
+	limits    Limits
+	startedAt time.Time
+	usage     *usageCollector
+	output    *outputGuard
+}
+
+func NewDockerManager(dockerClient *docker.Client, instanceID string, security SecurityConfig) *DockerManager {
+	return &DockerManager{
+		dockerClient: dockerClient,
+		instanceID:   instanceID,
+		security:     security,
+		sandboxes:    make(map[SandboxID]dockerSandbox),
+	}
 }
 
-func NewDockerManager(dockerClient *docker.Client) *DockerManager {
-	return &DockerManager{dockerClient}
+func (m *DockerManager) sandbox(id SandboxID) dockerSandbox {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.sandboxes[id]
 }
 
-func (m *DockerManager) CreateSandbox(ctx context.Context, image string, cmd []string) (SandboxID, error) {
+func (m *DockerManager) CreateSandbox(ctx context.Context, image string, cmd []string, limits Limits) (SandboxID, error) {
+	profile := m.security.profile(image)
+	hostConfig := profile.hostConfig(limits)
+
 	resp, err := m.dockerClient.ContainerCreate(
 		ctx,
 		&container.Config{
@@ -31,8 +61,15 @@ func (m *DockerManager) CreateSandbox(ctx context.Context, image string, cmd []s
 			StdinOnce:    true,
 			Image:        image,
 			Cmd:          cmd,
+			User:         profile.User,
+			Env:          profile.Env,
+			Labels:       sandboxLabels(ctx, m.instanceID),
+			// Files are copied in before the container starts, which Docker
+			// only allows into a volume when the root filesystem is
+			// read-only.
+			Volumes: map[string]struct{}{workVolume: {}},
 		},
-		nil,
+		hostConfig,
 		nil,
 		nil,
 		"",
@@ -41,14 +78,38 @@ func (m *DockerManager) CreateSandbox(ctx context.Context, image string, cmd []s
 		return "", err
 	}
 
+	m.mu.Lock()
+	m.sandboxes[resp.ID] = dockerSandbox{limits: limits}
+	m.mu.Unlock()
+
 	return resp.ID, nil
 }
 
 func (m *DockerManager) StartSandbox(ctx context.Context, id SandboxID) error {
-	return m.dockerClient.ContainerStart(ctx, id, container.StartOptions{})
+	err := m.dockerClient.ContainerStart(ctx, id, container.StartOptions{})
+	if err != nil {
+		return err
+	}
+
+	m.mu.Lock()
+	sandbox := m.sandboxes[id]
+	sandbox.startedAt = time.Now()
+	sandbox.usage = collectUsage(ctx, m.dockerClient, id)
+	if sandbox.limits.Output > 0 {
+		sandbox.output = newOutputGuard(sandbox.limits.Output, killSandbox(ctx, m.dockerClient, id))
+		go watchOutput(ctx, m.dockerClient, id, sandbox.output)
+	}
+	m.sandboxes[id] = sandbox
+	m.mu.Unlock()
+
+	return nil
 }
 
-func (m *DockerManager) AttachToSandbox(ctx context.Context, id SandboxID) (io.Reader, io.WriteCloser, error) {
+func (m *DockerManager) RestartSandbox(ctx context.Context, id SandboxID, keep []string) error {
+	return ErrRestartNotSupported
+}
+
+func (m *DockerManager) AttachToSandbox(ctx context.Context, id SandboxID) (*Attachment, error) {
 	resp, err := m.dockerClient.ContainerAttach(ctx, id, container.AttachOptions{
 		Stream: true,
 		Stdin:  true,
@@ -56,20 +117,45 @@ func (m *DockerManager) AttachToSandbox(ctx context.Context, id SandboxID) (io.R
 		Stderr: true,
 	})
 	if err != nil {
-		return nil, nil, err
+		return nil, err
 	}
-	return resp.Reader, resp.Conn, nil
+	return newHijackedAttachment(resp), nil
 }
 
 func (m *DockerManager) RemoveSandbox(ctx context.Context, id SandboxID) error {
-	return m.dockerClient.ContainerRemove(ctx, id, container.RemoveOptions{Force: true})
+	err := m.dockerClient.ContainerRemove(ctx, id, container.RemoveOptions{Force: true, RemoveVolumes: true})
+	if err != nil {
+		return err
+	}
+
+	m.mu.Lock()
+	m.sandboxes[id].usage.stop()
+	delete(m.sandboxes, id)
+	m.mu.Unlock()
+
+	return nil
 }
 
 func (m *DockerManager) CopyFileToSandbox(ctx context.Context, id SandboxID, path string, mode int64, data []byte) error {
+	name, err := filepath.Rel(workVolume, path)
+	if err != nil || !filepath.IsLocal(name) || filepath.Dir(name) == "." {
+		return fmt.Errorf("%s is outside of %s", path, WorkDir)
+	}
+
 	var buf bytes.Buffer
 	tw := tar.NewWriter(&buf)
+	// The directory is made writable for the sandbox user, so that the code
+	// can put its output next to the copied files.
+	dirHdr := &tar.Header{
+		Typeflag: tar.TypeDir,
+		Name:     filepath.Dir(name) + "/",
+		Mode:     01777,
+	}
+	if err := tw.WriteHeader(dirHdr); err != nil {
+		return err
+	}
 	hdr := &tar.Header{
-		Name: path,
+		Name: name,
 		Mode: mode,
 		Size: int64(len(data)),
 	}
@@ -81,12 +167,13 @@ func (m *DockerManager) CopyFileToSandbox(ctx context.Context, id SandboxID, pat
 	}
 	tw.Close()
 
+	// The files are owned by the user the sandbox runs as.
 	return m.dockerClient.CopyToContainer(
 		ctx,
 		id,
-		"/",
+		workVolume,
 		&buf,
-		container.CopyToContainerOptions{},
+		container.CopyToContainerOptions{CopyUIDGID: true},
 	)
 }
 
@@ -107,17 +194,78 @@ func (m *DockerManager) LoadFileFromSandbox(ctx context.Context, id SandboxID, p
 	return data, nil
 }
 
-func (m *DockerManager) WaitSandbox(ctx context.Context, id SandboxID) (StatusCode, error) {
+func (m *DockerManager) WaitSandbox(ctx context.Context, id SandboxID) (WaitResult, error) {
+	sandbox := m.sandbox(id)
+
+	var timeout <-chan time.Time
+	if sandbox.limits.WallTime > 0 && !sandbox.startedAt.IsZero() {
+		timer := time.NewTimer(time.Until(sandbox.startedAt.Add(sandbox.limits.WallTime)))
+		defer timer.Stop()
+		timeout = timer.C
+	}
+
 	statusCh, errCh := m.dockerClient.ContainerWait(ctx, id, container.WaitConditionNotRunning)
 	select {
 	case err := <-errCh:
-		return -1, err
+		return WaitResult{StatusCode: -1}, err
+	case status := <-statusCh:
+		return m.waitResult(ctx, id, sandbox, status.StatusCode, false)
+	case <-timeout:
+	}
+
+	// The container may exit on its own between the timer firing and the kill,
+	// in which case its real status is reported.
+	killErr := m.dockerClient.ContainerKill(ctx, id, "KILL")
+	select {
+	case err := <-errCh:
+		return WaitResult{StatusCode: -1}, err
 	case status := <-statusCh:
-		return status.StatusCode, nil
+		return m.waitResult(ctx, id, sandbox, status.StatusCode, killErr == nil)
+	}
+}
+
+func (m *DockerManager) waitResult(
+	ctx context.Context,
+	id SandboxID,
+	sandbox dockerSandbox,
+	statusCode StatusCode,
+	timedOut bool,
+) (WaitResult, error) {
+	cpuTime, peakMemory := sandbox.usage.stop()
+	result := WaitResult{
+		StatusCode: statusCode,
+		Signal:     signalFromStatusCode(statusCode),
+		CPUTime:    cpuTime,
+		PeakMemory: peakMemory,
+	}
+	switch {
+	case sandbox.output.tripped():
+		result.LimitExceeded = OutputLimitExceeded
+	case timedOut:
+		result.LimitExceeded = WallTimeLimitExceeded
+	}
+
+	inspect, err := m.dockerClient.ContainerInspect(ctx, id)
+	if err != nil {
+		return result, err
+	}
+	if inspect.State == nil {
+		return result, nil
+	}
+
+	startedAt, startErr := time.Parse(time.RFC3339Nano, inspect.State.StartedAt)
+	finishedAt, finishErr := time.Parse(time.RFC3339Nano, inspect.State.FinishedAt)
+	if startErr == nil && finishErr == nil {
+		result.WallTime = finishedAt.Sub(startedAt)
+	}
+	if result.LimitExceeded == NoLimitExceeded {
+		result.LimitExceeded = sandbox.limits.limitExceeded(statusCode, inspect.State.OOMKilled, cpuTime)
 	}
+
+	return result, nil
 }
 
-func (m *DockerManager) ReadLogsFromSandbox(ctx context.Context, id SandboxID) (string, error) {
+func (m *DockerManager) ReadLogsFromSandbox(ctx context.Context, id SandboxID) (Logs, error) {
 	reader, err := m.dockerClient.ContainerLogs(ctx, id, container.LogsOptions{
 		ShowStdout: true,
 		ShowStderr: true,
@@ -126,11 +274,12 @@ func (m *DockerManager) ReadLogsFromSandbox(ctx context.Context, id SandboxID) (
 		Follow:     false,
 	})
 	if err != nil {
-		return "", err
+		return Logs{}, err
 	}
 	defer reader.Close()
 
-	var buf bytes.Buffer
+	limits := m.sandbox(id).limits
+	var stdout, stderr bytes.Buffer
 
 	// Это код, сгенерированный DeepSeek для очистки строки от всякого мусора.
 	// Слава великой китайской абобе!
@@ -146,7 +295,7 @@ func (m *DockerManager) ReadLogsFromSandbox(ctx context.Context, id SandboxID) (
 			if err == io.EOF {
 				break
 			}
-			return "", fmt.Errorf("failed to read header: %w", err)
+			return Logs{}, fmt.Errorf("failed to read header: %w", err)
 		}
 
 		// Разбираем размер данных (последние 4 байта заголовка, big-endian)
@@ -156,12 +305,32 @@ func (m *DockerManager) ReadLogsFromSandbox(ctx context.Context, id SandboxID) (
 		data := make([]byte, dataSize)
 		_, err = io.ReadFull(reader, data)
 		if err != nil {
-			return "", fmt.Errorf("failed to read data: %w", err)
+			return Logs{}, fmt.Errorf("failed to read data: %w", err)
 		}
 
-		// Записываем данные в буфер
+		// Первый байт заголовка - номер потока: 1 для stdout, 2 для stderr
+		buf := &stdout
+		if stdcopy.StdType(header[0]) == stdcopy.Stderr {
+			buf = &stderr
+		}
 		buf.Write(data)
+
+		if limits.Output > 0 && int64(buf.Len()) > limits.Output {
+			break
+		}
 	}
 
-	return buf.String(), nil
+	return limits.truncateLogs(stdout.Bytes(), stderr.Bytes())
+}
+
+func (m *DockerManager) ImageDigest(ctx context.Context, image string) (string, error) {
+	return imageDigest(ctx, m.dockerClient, image)
+}
+
+func imageDigest(ctx context.Context, dockerClient *docker.Client, image string) (string, error) {
+	inspect, err := dockerClient.ImageInspect(ctx, image)
+	if err != nil {
+		return "", err
+	}
+	return inspect.ID, nil
 }
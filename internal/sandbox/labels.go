@@ -0,0 +1,33 @@
+package sandbox
+
+import (
+	"context"
+	"time"
+)
+
+// Labels put on every sandbox container, so that containers left behind by a
+// crashed runner can be found and removed.
+const (
+	instanceLabel = "coderunner.instance"
+	taskLabel     = "coderunner.task"
+	createdLabel  = "coderunner.created"
+)
+
+type taskIDKey struct{}
+
+// WithTaskID returns a context that labels the sandboxes created with it as
+// belonging to the given task.
+func WithTaskID(ctx context.Context, taskID string) context.Context {
+	return context.WithValue(ctx, taskIDKey{}, taskID)
+}
+
+func sandboxLabels(ctx context.Context, instanceID string) map[string]string {
+	labels := map[string]string{
+		instanceLabel: instanceID,
+		createdLabel:  time.Now().UTC().Format(time.RFC3339),
+	}
+	if taskID, ok := ctx.Value(taskIDKey{}).(string); ok {
+		labels[taskLabel] = taskID
+	}
+	return labels
+}
@@ -2,7 +2,6 @@ package sandbox
 
 import (
 	"context"
-	"io"
 )
 
 type ConcurrencyLimitDecorator struct {
@@ -30,12 +29,12 @@ func (d *ConcurrencyLimitDecorator) release() {
 	<-d.semaphore
 }
 
-func (d *ConcurrencyLimitDecorator) CreateSandbox(ctx context.Context, image string, cmd []string) (SandboxID, error) {
+func (d *ConcurrencyLimitDecorator) CreateSandbox(ctx context.Context, image string, cmd []string, limits Limits) (SandboxID, error) {
 	if err := d.acquire(ctx); err != nil {
 		return "", err
 	}
 	defer d.release()
-	return d.manager.CreateSandbox(ctx, image, cmd)
+	return d.manager.CreateSandbox(ctx, image, cmd, limits)
 }
 
 func (d *ConcurrencyLimitDecorator) StartSandbox(ctx context.Context, id SandboxID) error {
@@ -46,9 +45,17 @@ func (d *ConcurrencyLimitDecorator) StartSandbox(ctx context.Context, id Sandbox
 	return d.manager.StartSandbox(ctx, id)
 }
 
-func (d *ConcurrencyLimitDecorator) AttachToSandbox(ctx context.Context, id SandboxID) (io.Reader, io.WriteCloser, error) {
+func (d *ConcurrencyLimitDecorator) RestartSandbox(ctx context.Context, id SandboxID, keep []string) error {
 	if err := d.acquire(ctx); err != nil {
-		return nil, nil, err
+		return err
+	}
+	defer d.release()
+	return d.manager.RestartSandbox(ctx, id, keep)
+}
+
+func (d *ConcurrencyLimitDecorator) AttachToSandbox(ctx context.Context, id SandboxID) (*Attachment, error) {
+	if err := d.acquire(ctx); err != nil {
+		return nil, err
 	}
 	defer d.release()
 	return d.manager.AttachToSandbox(ctx, id)
@@ -78,18 +85,26 @@ func (d *ConcurrencyLimitDecorator) LoadFileFromSandbox(ctx context.Context, id
 	return d.manager.LoadFileFromSandbox(ctx, id, path)
 }
 
-func (d *ConcurrencyLimitDecorator) WaitSandbox(ctx context.Context, id SandboxID) (StatusCode, error) {
+func (d *ConcurrencyLimitDecorator) WaitSandbox(ctx context.Context, id SandboxID) (WaitResult, error) {
 	if err := d.acquire(ctx); err != nil {
-		return -1, err
+		return WaitResult{StatusCode: -1}, err
 	}
 	defer d.release()
 	return d.manager.WaitSandbox(ctx, id)
 }
 
-func (d *ConcurrencyLimitDecorator) ReadLogsFromSandbox(ctx context.Context, id SandboxID) (string, error) {
+func (d *ConcurrencyLimitDecorator) ReadLogsFromSandbox(ctx context.Context, id SandboxID) (Logs, error) {
 	if err := d.acquire(ctx); err != nil {
-		return "", err
+		return Logs{}, err
 	}
 	defer d.release()
 	return d.manager.ReadLogsFromSandbox(ctx, id)
 }
+
+func (d *ConcurrencyLimitDecorator) ImageDigest(ctx context.Context, image string) (string, error) {
+	if err := d.acquire(ctx); err != nil {
+		return "", err
+	}
+	defer d.release()
+	return d.manager.ImageDigest(ctx, image)
+}
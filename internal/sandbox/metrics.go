@@ -0,0 +1,129 @@
+package sandbox
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+var (
+	operationDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "coderunner_sandbox_operation_duration_seconds",
+		Help:    "Duration of sandbox.Manager calls.",
+		Buckets: prometheus.ExponentialBuckets(0.005, 2, 14),
+	}, []string{"method"})
+	operationErrors = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "coderunner_sandbox_operation_errors_total",
+		Help: "Failed sandbox.Manager calls.",
+	}, []string{"method"})
+	activeSandboxes = promauto.NewGauge(prometheus.GaugeOpts{
+		Name: "coderunner_sandboxes_active",
+		Help: "Sandboxes created and not removed yet.",
+	})
+)
+
+// MetricsDecorator records the latency and errors of every call and the
+// number of active sandboxes.
+type MetricsDecorator struct {
+	manager Manager
+}
+
+func NewMetricsDecorator(manager Manager) Manager {
+	return &MetricsDecorator{manager: manager}
+}
+
+func observe(method string, start time.Time, err error) {
+	operationDuration.WithLabelValues(method).Observe(time.Since(start).Seconds())
+	if err != nil {
+		operationErrors.WithLabelValues(method).Inc()
+	}
+}
+
+func (d *MetricsDecorator) CreateSandbox(ctx context.Context, image string, cmd []string, limits Limits) (SandboxID, error) {
+	start := time.Now()
+	id, err := d.manager.CreateSandbox(ctx, image, cmd, limits)
+	observe("CreateSandbox", start, err)
+	if err == nil {
+		activeSandboxes.Inc()
+	}
+	return id, err
+}
+
+func (d *MetricsDecorator) StartSandbox(ctx context.Context, id SandboxID) error {
+	start := time.Now()
+	err := d.manager.StartSandbox(ctx, id)
+	observe("StartSandbox", start, err)
+	return err
+}
+
+func (d *MetricsDecorator) RestartSandbox(ctx context.Context, id SandboxID, keep []string) error {
+	start := time.Now()
+	err := d.manager.RestartSandbox(ctx, id, keep)
+	// Some managers never support restarting, which isn't a failure.
+	failure := err
+	if errors.Is(err, ErrRestartNotSupported) {
+		failure = nil
+	}
+	observe("RestartSandbox", start, failure)
+	return err
+}
+
+func (d *MetricsDecorator) AttachToSandbox(ctx context.Context, id SandboxID) (*Attachment, error) {
+	start := time.Now()
+	attachment, err := d.manager.AttachToSandbox(ctx, id)
+	observe("AttachToSandbox", start, err)
+	return attachment, err
+}
+
+func (d *MetricsDecorator) RemoveSandbox(ctx context.Context, id SandboxID) error {
+	start := time.Now()
+	err := d.manager.RemoveSandbox(ctx, id)
+	observe("RemoveSandbox", start, err)
+	if err == nil {
+		activeSandboxes.Dec()
+	}
+	return err
+}
+
+func (d *MetricsDecorator) CopyFileToSandbox(ctx context.Context, id SandboxID, path string, mode int64, data []byte) error {
+	start := time.Now()
+	err := d.manager.CopyFileToSandbox(ctx, id, path, mode, data)
+	observe("CopyFileToSandbox", start, err)
+	return err
+}
+
+func (d *MetricsDecorator) LoadFileFromSandbox(ctx context.Context, id SandboxID, path string) ([]byte, error) {
+	start := time.Now()
+	data, err := d.manager.LoadFileFromSandbox(ctx, id, path)
+	observe("LoadFileFromSandbox", start, err)
+	return data, err
+}
+
+func (d *MetricsDecorator) WaitSandbox(ctx context.Context, id SandboxID) (WaitResult, error) {
+	start := time.Now()
+	result, err := d.manager.WaitSandbox(ctx, id)
+	observe("WaitSandbox", start, err)
+	return result, err
+}
+
+func (d *MetricsDecorator) ReadLogsFromSandbox(ctx context.Context, id SandboxID) (Logs, error) {
+	start := time.Now()
+	logs, err := d.manager.ReadLogsFromSandbox(ctx, id)
+	// Truncated output is reported along with the logs, it isn't a failure.
+	failure := err
+	if errors.Is(err, ErrOutputLimitExceeded) {
+		failure = nil
+	}
+	observe("ReadLogsFromSandbox", start, failure)
+	return logs, err
+}
+
+func (d *MetricsDecorator) ImageDigest(ctx context.Context, image string) (string, error) {
+	start := time.Now()
+	digest, err := d.manager.ImageDigest(ctx, image)
+	observe("ImageDigest", start, err)
+	return digest, err
+}
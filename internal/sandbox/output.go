@@ -0,0 +1,88 @@
+package sandbox
+
+import (
+	"context"
+	"io"
+	"sync"
+	"sync/atomic"
+
+	"github.com/docker/docker/api/types/container"
+	docker "github.com/docker/docker/client"
+	"github.com/docker/docker/pkg/stdcopy"
+)
+
+// outputGuard kills a sandbox as soon as it writes more than the output limit
+// to stdout or stderr, so that a program printing in a loop can't flood the
+// runner or the Docker daemon while nobody is reading its output yet.
+type outputGuard struct {
+	limit    int64
+	kill     func()
+	once     sync.Once
+	exceeded atomic.Bool
+}
+
+func newOutputGuard(limit int64, kill func()) *outputGuard {
+	return &outputGuard{limit: limit, kill: kill}
+}
+
+// writer counts the bytes of one stream written through it to dst, a nil dst
+// discards them.
+func (g *outputGuard) writer(dst io.Writer) io.Writer {
+	return &guardedWriter{guard: g, dst: dst}
+}
+
+func (g *outputGuard) trip() {
+	g.once.Do(func() {
+		g.exceeded.Store(true)
+		g.kill()
+	})
+}
+
+// tripped reports whether the sandbox was killed for exceeding the limit. It
+// is safe to call on a nil guard.
+func (g *outputGuard) tripped() bool {
+	return g != nil && g.exceeded.Load()
+}
+
+type guardedWriter struct {
+	guard   *outputGuard
+	dst     io.Writer
+	written int64
+}
+
+func (w *guardedWriter) Write(p []byte) (int, error) {
+	w.written += int64(len(p))
+	if w.guard.limit > 0 && w.written > w.guard.limit {
+		w.guard.trip()
+	}
+	if w.dst == nil {
+		return len(p), nil
+	}
+	return w.dst.Write(p)
+}
+
+// killSandbox returns a function that kills the container of the sandbox,
+// regardless of whether ctx is cancelled by then.
+func killSandbox(ctx context.Context, dockerClient *docker.Client, id SandboxID) func() {
+	ctx = context.WithoutCancel(ctx)
+	return func() {
+		// The container may have exited on its own in the meantime.
+		dockerClient.ContainerKill(ctx, id, "KILL")
+	}
+}
+
+// watchOutput follows the logs of a running container and feeds them to the
+// guard until the container exits.
+func watchOutput(ctx context.Context, dockerClient *docker.Client, id SandboxID, guard *outputGuard) {
+	reader, err := dockerClient.ContainerLogs(ctx, id, container.LogsOptions{
+		ShowStdout: true,
+		ShowStderr: true,
+		Follow:     true,
+	})
+	if err != nil {
+		return
+	}
+	defer reader.Close()
+
+	stdcopy.StdCopy(guard.writer(nil), guard.writer(nil), reader)
+}
@@ -0,0 +1,315 @@
+package sandbox
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/docker/docker/api/types/container"
+	docker "github.com/docker/docker/client"
+)
+
+type PoolConfig struct {
+	// Size is the number of idle containers kept per image.
+	Size int
+	// MaxUses is the number of sandboxes a container runs before it is
+	// replaced, zero means no limit.
+	MaxUses int
+	// MaxAge must be below the age at which the reaper removes containers.
+	MaxAge time.Duration
+}
+
+// PoolManager runs sandboxes in idle containers like TMPFSDockerManager, but
+// instead of removing a container along with its sandbox it wipes the work
+// dirs and keeps it for the next sandbox of the same image. A container is
+// replaced after MaxUses sandboxes, once it gets older than MaxAge, or when
+// anything about it looks wrong, e.g. the sandbox was killed or left
+// processes behind.
+//
+// Memory and pids limits are applied to a container when it's handed out.
+// The CPU time limit is set by a shell wrapping the command, so the images
+// must have /bin/sh. Sandboxes without a memory limit aren't pooled, since
+// it can't be lifted from a container once set, nor those needing a larger
+// work dir than the containers were created with, and neither are the images
+// whose profile leaves the rootfs writable, since wiping the work dirs
+// wouldn't undo what a sandbox changed elsewhere.
+type PoolManager struct {
+	manager *TMPFSDockerManager
+	config  PoolConfig
+
+	mu       sync.Mutex
+	idle     map[string][]*pooledContainer
+	leased   map[SandboxID]*pooledContainer
+	creating map[string]int
+	closed   bool
+}
+
+type pooledContainer struct {
+	id        SandboxID
+	image     string
+	createdAt time.Time
+	uses      int
+}
+
+func NewPoolManager(dockerClient *docker.Client, instanceID string, security SecurityConfig, config PoolConfig) *PoolManager {
+	return &PoolManager{
+		manager:  newTMPFSDockerManager(dockerClient, instanceID, security),
+		config:   config,
+		idle:     make(map[string][]*pooledContainer),
+		leased:   make(map[SandboxID]*pooledContainer),
+		creating: make(map[string]int),
+	}
+}
+
+// Warm fills the pool of each image up to its size.
+func (m *PoolManager) Warm(ctx context.Context, images ...string) error {
+	var errs []error
+	for _, image := range images {
+		if !m.pooled(image) {
+			continue
+		}
+		if err := m.fill(ctx, image); err != nil {
+			errs = append(errs, fmt.Errorf("image %s: %w", image, err))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// Close removes the idle containers and stops the pool from keeping the
+// leased ones once they are returned.
+func (m *PoolManager) Close(ctx context.Context) error {
+	m.mu.Lock()
+	m.closed = true
+	var containers []*pooledContainer
+	for image, idle := range m.idle {
+		containers = append(containers, idle...)
+		delete(m.idle, image)
+	}
+	m.mu.Unlock()
+
+	var errs []error
+	for _, c := range containers {
+		if err := m.removeContainer(ctx, c.id); err != nil {
+			errs = append(errs, fmt.Errorf("container %s: %w", c.id, err))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+func (m *PoolManager) fill(ctx context.Context, image string) error {
+	m.mu.Lock()
+	missing := m.config.Size - len(m.idle[image]) - m.creating[image]
+	if m.closed || missing <= 0 {
+		m.mu.Unlock()
+		return nil
+	}
+	m.creating[image] += missing
+	m.mu.Unlock()
+
+	var errs []error
+	for range missing {
+		id, err := m.manager.createContainer(ctx, image, Limits{})
+
+		m.mu.Lock()
+		m.creating[image]--
+		closed := m.closed
+		if err == nil && !closed {
+			m.idle[image] = append(m.idle[image], &pooledContainer{
+				id:        id,
+				image:     image,
+				createdAt: time.Now(),
+			})
+		}
+		m.mu.Unlock()
+
+		if err != nil {
+			errs = append(errs, err)
+		} else if closed {
+			m.removeContainer(ctx, id)
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// take hands out an idle container of the image if there is a healthy one.
+func (m *PoolManager) take(ctx context.Context, image string) *pooledContainer {
+	for {
+		m.mu.Lock()
+		idle := m.idle[image]
+		if len(idle) == 0 {
+			m.mu.Unlock()
+			return nil
+		}
+		c := idle[len(idle)-1]
+		m.idle[image] = idle[:len(idle)-1]
+		m.mu.Unlock()
+
+		// The container could have been killed or reaped while idle.
+		inspect, err := m.manager.dockerClient.ContainerInspect(ctx, c.id)
+		if err == nil && inspect.State != nil && inspect.State.Running && !m.expired(c) {
+			return c
+		}
+		m.removeContainer(context.WithoutCancel(ctx), c.id)
+	}
+}
+
+func (m *PoolManager) pooled(image string) bool {
+	return m.manager.security.profile(image).ReadOnlyRootfs
+}
+
+func (m *PoolManager) expired(c *pooledContainer) bool {
+	return (m.config.MaxUses > 0 && c.uses >= m.config.MaxUses) ||
+		(m.config.MaxAge > 0 && time.Since(c.createdAt) >= m.config.MaxAge)
+}
+
+func (m *PoolManager) CreateSandbox(ctx context.Context, image string, cmd []string, limits Limits) (SandboxID, error) {
+	if limits.Memory <= 0 || limits.workDirSize() > defaultWorkDirSize || !m.pooled(image) {
+		return m.manager.CreateSandbox(ctx, image, cmd, limits)
+	}
+
+	c := m.take(ctx, image)
+	// Whatever was taken, the pool is topped up in the background. The
+	// containers aren't labelled with the task, which may not be theirs.
+	go m.fill(context.Background(), image)
+
+	if c == nil {
+		id, err := m.manager.createContainer(ctx, image, Limits{})
+		if err != nil {
+			return "", err
+		}
+		c = &pooledContainer{id: id, image: image, createdAt: time.Now()}
+	}
+
+	err := m.applyLimits(ctx, c, limits)
+	if err != nil {
+		// E.g. the memory in use is above the new limit.
+		m.removeContainer(context.WithoutCancel(ctx), c.id)
+		return m.manager.CreateSandbox(ctx, image, cmd, limits)
+	}
+
+	m.mu.Lock()
+	m.leased[c.id] = c
+	m.mu.Unlock()
+
+	m.manager.adopt(c.id, cpuLimitedCmd(cmd, limits.CPUTime), limits)
+	return c.id, nil
+}
+
+func (m *PoolManager) applyLimits(ctx context.Context, c *pooledContainer, limits Limits) error {
+	pids := limits.Pids
+	if pids <= 0 {
+		pids = m.manager.security.profile(c.image).PidsLimit
+	}
+	resources := container.Resources{
+		Memory:     limits.Memory,
+		MemorySwap: limits.Memory,
+	}
+	if pids > 0 {
+		resources.PidsLimit = &pids
+	}
+	_, err := m.manager.dockerClient.ContainerUpdate(ctx, c.id, container.UpdateConfig{Resources: resources})
+	return err
+}
+
+// cpuLimitedCmd makes cmd run with the same RLIMIT_CPU that Limits.resources
+// sets for a whole container.
+func cpuLimitedCmd(cmd []string, cpuTime time.Duration) []string {
+	if cpuTime <= 0 {
+		return cmd
+	}
+	seconds := int64((cpuTime + time.Second - 1) / time.Second)
+	return append([]string{
+		"/bin/sh", "-c", `ulimit -H -t "$1" && ulimit -S -t "$2" && shift 2 && exec "$@"`, "sh",
+		strconv.FormatInt(seconds+1, 10), strconv.FormatInt(seconds, 10),
+	}, cmd...)
+}
+
+// RemoveSandbox returns the container to the pool if it can be reused.
+func (m *PoolManager) RemoveSandbox(ctx context.Context, id SandboxID) error {
+	m.mu.Lock()
+	c, ok := m.leased[id]
+	delete(m.leased, id)
+	m.mu.Unlock()
+	if !ok {
+		return m.manager.RemoveSandbox(ctx, id)
+	}
+
+	sandbox := m.manager.release(id)
+	c.uses++
+
+	if sandbox.guard.tripped() || m.expired(c) {
+		return m.removeContainer(ctx, id)
+	}
+	// The container stays marked as OOM killed, which would be blamed on
+	// every later sandbox.
+	oomKilled, err := m.manager.oomKilled(ctx, id)
+	if err != nil || oomKilled {
+		return m.removeContainer(ctx, id)
+	}
+	// Also wipes /dev/shm, which outlives the processes of the sandbox.
+	if m.manager.wipe(ctx, id, nil) != nil {
+		return m.removeContainer(ctx, id)
+	}
+
+	m.mu.Lock()
+	keep := !m.closed && len(m.idle[c.image]) < m.config.Size
+	if keep {
+		m.idle[c.image] = append(m.idle[c.image], c)
+	}
+	m.mu.Unlock()
+
+	if !keep {
+		return m.removeContainer(ctx, id)
+	}
+	return nil
+}
+
+func (m *PoolManager) removeContainer(ctx context.Context, id SandboxID) error {
+	return m.manager.dockerClient.ContainerRemove(ctx, id, container.RemoveOptions{Force: true})
+}
+
+// RestartSandbox counts every run in a leased container as a use, so that a
+// container running all the tests of a task is still replaced in time.
+func (m *PoolManager) RestartSandbox(ctx context.Context, id SandboxID, keep []string) error {
+	m.mu.Lock()
+	c, ok := m.leased[id]
+	m.mu.Unlock()
+	if ok {
+		c.uses++
+		if m.expired(c) {
+			return ErrRestartNotSupported
+		}
+	}
+	return m.manager.RestartSandbox(ctx, id, keep)
+}
+
+func (m *PoolManager) StartSandbox(ctx context.Context, id SandboxID) error {
+	return m.manager.StartSandbox(ctx, id)
+}
+
+func (m *PoolManager) AttachToSandbox(ctx context.Context, id SandboxID) (*Attachment, error) {
+	return m.manager.AttachToSandbox(ctx, id)
+}
+
+func (m *PoolManager) CopyFileToSandbox(ctx context.Context, id SandboxID, path string, mode int64, data []byte) error {
+	return m.manager.CopyFileToSandbox(ctx, id, path, mode, data)
+}
+
+func (m *PoolManager) LoadFileFromSandbox(ctx context.Context, id SandboxID, path string) ([]byte, error) {
+	return m.manager.LoadFileFromSandbox(ctx, id, path)
+}
+
+func (m *PoolManager) WaitSandbox(ctx context.Context, id SandboxID) (WaitResult, error) {
+	return m.manager.WaitSandbox(ctx, id)
+}
+
+func (m *PoolManager) ReadLogsFromSandbox(ctx context.Context, id SandboxID) (Logs, error) {
+	return m.manager.ReadLogsFromSandbox(ctx, id)
+}
+
+func (m *PoolManager) ImageDigest(ctx context.Context, image string) (string, error) {
+	return m.manager.ImageDigest(ctx, image)
+}
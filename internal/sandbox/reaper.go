@@ -0,0 +1,125 @@
+package sandbox
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/docker/docker/api/types/container"
+	"github.com/docker/docker/api/types/filters"
+	docker "github.com/docker/docker/client"
+	"github.com/t3m8ch/coderunner/internal/logging"
+)
+
+// InstanceChecker reports whether the runner instance with the given ID is
+// still running.
+type InstanceChecker func(ctx context.Context, instanceID string) (bool, error)
+
+// Reaper removes sandbox containers that outlived the runner which created
+// them, or that are older than maxAge.
+type Reaper struct {
+	dockerClient *docker.Client
+	instanceID   string
+	maxAge       time.Duration
+	isAlive      InstanceChecker
+}
+
+func NewReaper(
+	dockerClient *docker.Client,
+	instanceID string,
+	maxAge time.Duration,
+	isAlive InstanceChecker,
+) *Reaper {
+	return &Reaper{
+		dockerClient: dockerClient,
+		instanceID:   instanceID,
+		maxAge:       maxAge,
+		isAlive:      isAlive,
+	}
+}
+
+// Run sweeps every interval until ctx is cancelled.
+func (r *Reaper) Run(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		removed, err := r.Sweep(ctx)
+		if err != nil {
+			logging.FromContext(ctx).Error("Error reaping sandboxes", "error", err)
+		}
+		if removed > 0 {
+			logging.FromContext(ctx).Info("Reaped orphaned sandboxes", "count", removed)
+		}
+	}
+}
+
+// Sweep removes the orphaned sandboxes once and returns how many were removed.
+func (r *Reaper) Sweep(ctx context.Context) (int, error) {
+	containers, err := r.dockerClient.ContainerList(ctx, container.ListOptions{
+		All:     true,
+		Filters: filters.NewArgs(filters.Arg("label", instanceLabel)),
+	})
+	if err != nil {
+		return 0, err
+	}
+
+	var errs []error
+	alive := make(map[string]bool)
+	removed := 0
+	for _, c := range containers {
+		orphaned, err := r.orphaned(ctx, c, alive)
+		if err != nil {
+			errs = append(errs, err)
+			continue
+		}
+		if !orphaned {
+			continue
+		}
+
+		err = r.dockerClient.ContainerRemove(ctx, c.ID, container.RemoveOptions{Force: true, RemoveVolumes: true})
+		if err != nil && !docker.IsErrNotFound(err) {
+			errs = append(errs, fmt.Errorf("sandbox %s: %w", c.ID, err))
+			continue
+		}
+		removed++
+	}
+
+	return removed, errors.Join(errs...)
+}
+
+func (r *Reaper) orphaned(ctx context.Context, c container.Summary, alive map[string]bool) (bool, error) {
+	createdAt := time.Unix(c.Created, 0)
+	if value, ok := c.Labels[createdLabel]; ok {
+		if parsed, err := time.Parse(time.RFC3339, value); err == nil {
+			createdAt = parsed
+		}
+	}
+	if r.maxAge > 0 && time.Since(createdAt) > r.maxAge {
+		return true, nil
+	}
+
+	instanceID := c.Labels[instanceLabel]
+	if instanceID == r.instanceID || r.isAlive == nil {
+		return false, nil
+	}
+
+	isAlive, ok := alive[instanceID]
+	if !ok {
+		var err error
+		isAlive, err = r.isAlive(ctx, instanceID)
+		if err != nil {
+			return false, fmt.Errorf("checking instance %s: %w", instanceID, err)
+		}
+		alive[instanceID] = isAlive
+	}
+
+	return !isAlive, nil
+}
@@ -0,0 +1,142 @@
+package sandbox
+
+import (
+	"bytes"
+	"errors"
+	"time"
+
+	"github.com/docker/docker/api/types/container"
+	"github.com/docker/go-units"
+)
+
+// Limits bounds the resources a sandbox may use. Zero values mean "no limit".
+type Limits struct {
+	WallTime time.Duration
+	CPUTime  time.Duration
+	Memory   int64
+	Pids     int64
+	Output   int64
+	// WorkDirSize bounds the work dir of managers that keep it in memory and
+	// every file written in a sandbox, zero means defaultWorkDirSize.
+	WorkDirSize int64
+}
+
+const defaultWorkDirSize = 64 << 20
+
+func (l Limits) workDirSize() int64 {
+	if l.WorkDirSize > 0 {
+		return l.WorkDirSize
+	}
+	return defaultWorkDirSize
+}
+
+type LimitKind = string
+
+const (
+	NoLimitExceeded       LimitKind = ""
+	WallTimeLimitExceeded LimitKind = "wall_time"
+	CPUTimeLimitExceeded  LimitKind = "cpu_time"
+	MemoryLimitExceeded   LimitKind = "memory"
+	OutputLimitExceeded   LimitKind = "output"
+)
+
+type WaitResult struct {
+	StatusCode    StatusCode
+	Signal        int
+	LimitExceeded LimitKind
+	WallTime      time.Duration
+	CPUTime       time.Duration
+	PeakMemory    int64
+}
+
+// Logs is the output of a sandbox.
+type Logs struct {
+	Stdout string
+	Stderr string
+}
+
+// Combined returns stdout followed by stderr.
+func (l Logs) Combined() string {
+	return l.Stdout + l.Stderr
+}
+
+// ErrOutputLimitExceeded is returned together with the truncated output when
+// a sandbox writes more than Limits.Output bytes to stdout or stderr.
+var ErrOutputLimitExceeded = errors.New("output limit exceeded")
+
+// Exit code of a process terminated by SIGXCPU, which the kernel sends when
+// the soft RLIMIT_CPU is reached.
+const sigxcpuStatusCode = signalStatusBase + 24
+
+// Exit code of a process terminated by SIGKILL, which is how the OOM killer
+// ends it.
+const sigkillStatusCode = signalStatusBase + 9
+
+func (l Limits) resources() container.Resources {
+	var resources container.Resources
+	if l.Memory > 0 {
+		resources.Memory = l.Memory
+		resources.MemorySwap = l.Memory
+	}
+	if l.Pids > 0 {
+		pids := l.Pids
+		resources.PidsLimit = &pids
+	}
+	if l.CPUTime > 0 {
+		seconds := int64((l.CPUTime + time.Second - 1) / time.Second)
+		resources.Ulimits = append(resources.Ulimits, &units.Ulimit{Name: "cpu", Soft: seconds, Hard: seconds + 1})
+	}
+	// The work dir of DockerManager is a volume on the disk of the host,
+	// which only RLIMIT_FSIZE keeps a sandbox from filling with one file.
+	size := l.workDirSize()
+	resources.Ulimits = append(resources.Ulimits, &units.Ulimit{Name: "fsize", Soft: size, Hard: size})
+	return resources
+}
+
+func (l Limits) limitExceeded(statusCode StatusCode, oomKilled bool, cpuTime time.Duration) LimitKind {
+	switch {
+	// A container stays marked as OOM killed until it is started again, an
+	// exec of a reused one may have been run after the kill.
+	case oomKilled && statusCode == sigkillStatusCode:
+		return MemoryLimitExceeded
+	case l.CPUTime <= 0:
+		return NoLimitExceeded
+	// RLIMIT_CPU only counts whole seconds, the measured CPU time tells
+	// whether the limit was exceeded to the millisecond. It also tells a
+	// process that ignored SIGXCPU and was killed at the hard limit from one
+	// killed for any other reason, which is a runtime error.
+	case statusCode == sigxcpuStatusCode || cpuTime > l.CPUTime:
+		return CPUTimeLimitExceeded
+	default:
+		return NoLimitExceeded
+	}
+}
+
+// truncateLogs applies the output limit to each of the streams.
+func (l Limits) truncateLogs(stdout, stderr []byte) (Logs, error) {
+	var err error
+	if l.Output > 0 && int64(len(stdout)) > l.Output {
+		stdout, err = stdout[:l.Output], ErrOutputLimitExceeded
+	}
+	if l.Output > 0 && int64(len(stderr)) > l.Output {
+		stderr, err = stderr[:l.Output], ErrOutputLimitExceeded
+	}
+	return Logs{Stdout: string(stdout), Stderr: string(stderr)}, err
+}
+
+// cappedBuffer keeps at most limit bytes written to it and discards the rest,
+// a negative limit means no limit.
+type cappedBuffer struct {
+	bytes.Buffer
+	limit int64
+}
+
+func (b *cappedBuffer) Write(p []byte) (int, error) {
+	if b.limit >= 0 {
+		if free := b.limit - int64(b.Len()); int64(len(p)) > free {
+			b.Buffer.Write(p[:max(free, 0)])
+			return len(p), nil
+		}
+	}
+	return b.Buffer.Write(p)
+}
@@ -2,8 +2,8 @@ package sandbox
 
 import (
 	"context"
+	"errors"
 	"fmt"
-	"io"
 	"time"
 )
 
@@ -41,14 +41,16 @@ func (d *RetryDecorator) retry(ctx context.Context, fn func() error) error {
 }
 
 func isRetryable(err error) bool {
-	return err != context.Canceled && err != context.DeadlineExceeded
+	return !errors.Is(err, context.Canceled) &&
+		!errors.Is(err, context.DeadlineExceeded) &&
+		!errors.Is(err, ErrOutputLimitExceeded)
 }
 
-func (d *RetryDecorator) CreateSandbox(ctx context.Context, image string, cmd []string) (SandboxID, error) {
+func (d *RetryDecorator) CreateSandbox(ctx context.Context, image string, cmd []string, limits Limits) (SandboxID, error) {
 	var id SandboxID
 	var err error
 	fn := func() error {
-		id, err = d.manager.CreateSandbox(ctx, image, cmd)
+		id, err = d.manager.CreateSandbox(ctx, image, cmd, limits)
 		return err
 	}
 	if err := d.retry(ctx, fn); err != nil {
@@ -64,18 +66,23 @@ func (d *RetryDecorator) StartSandbox(ctx context.Context, id SandboxID) error {
 	return d.retry(ctx, fn)
 }
 
-func (d *RetryDecorator) AttachToSandbox(ctx context.Context, id SandboxID) (io.Reader, io.WriteCloser, error) {
-	var reader io.Reader
-	var writer io.WriteCloser
+// RestartSandbox isn't retried, a sandbox that failed to restart is replaced
+// with a new one anyway.
+func (d *RetryDecorator) RestartSandbox(ctx context.Context, id SandboxID, keep []string) error {
+	return d.manager.RestartSandbox(ctx, id, keep)
+}
+
+func (d *RetryDecorator) AttachToSandbox(ctx context.Context, id SandboxID) (*Attachment, error) {
+	var attachment *Attachment
 	var err error
 	fn := func() error {
-		reader, writer, err = d.manager.AttachToSandbox(ctx, id)
+		attachment, err = d.manager.AttachToSandbox(ctx, id)
 		return err
 	}
 	if err := d.retry(ctx, fn); err != nil {
-		return nil, nil, err
+		return nil, err
 	}
-	return reader, writer, nil
+	return attachment, nil
 }
 
 func (d *RetryDecorator) RemoveSandbox(ctx context.Context, id SandboxID) error {
@@ -105,28 +112,41 @@ func (d *RetryDecorator) LoadFileFromSandbox(ctx context.Context, id SandboxID,
 	return data, nil
 }
 
-func (d *RetryDecorator) WaitSandbox(ctx context.Context, id SandboxID) (StatusCode, error) {
-	var code StatusCode
+func (d *RetryDecorator) WaitSandbox(ctx context.Context, id SandboxID) (WaitResult, error) {
+	var result WaitResult
 	var err error
 	fn := func() error {
-		code, err = d.manager.WaitSandbox(ctx, id)
+		result, err = d.manager.WaitSandbox(ctx, id)
 		return err
 	}
 	if err := d.retry(ctx, fn); err != nil {
-		return -1, err
+		return WaitResult{StatusCode: -1}, err
 	}
-	return code, nil
+	return result, nil
 }
 
-func (d *RetryDecorator) ReadLogsFromSandbox(ctx context.Context, id SandboxID) (string, error) {
-	var logs string
+func (d *RetryDecorator) ReadLogsFromSandbox(ctx context.Context, id SandboxID) (Logs, error) {
+	var logs Logs
 	var err error
 	fn := func() error {
 		logs, err = d.manager.ReadLogsFromSandbox(ctx, id)
 		return err
 	}
 	if err := d.retry(ctx, fn); err != nil {
-		return "", err
+		return logs, err
 	}
 	return logs, nil
 }
+
+func (d *RetryDecorator) ImageDigest(ctx context.Context, image string) (string, error) {
+	var digest string
+	var err error
+	fn := func() error {
+		digest, err = d.manager.ImageDigest(ctx, image)
+		return err
+	}
+	if err := d.retry(ctx, fn); err != nil {
+		return "", err
+	}
+	return digest, nil
+}
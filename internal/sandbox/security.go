@@ -0,0 +1,139 @@
+package sandbox
+
+import (
+	"encoding/json"
+	"fmt"
+	"maps"
+	"os"
+	"strings"
+
+	"github.com/docker/docker/api/types/container"
+)
+
+// SecurityProfile restricts what the code running in a sandbox may do.
+type SecurityProfile struct {
+	NetworkMode string   `json:"networkMode"`
+	User        string   `json:"user"`
+	CapAdd      []string `json:"capAdd"`
+	Env         []string `json:"env"`
+	// ReadOnlyRootfs makes everything but the working dir and Tmpfs mounts
+	// read-only.
+	ReadOnlyRootfs bool              `json:"readOnlyRootfs"`
+	Tmpfs          map[string]string `json:"tmpfs"`
+	// Seccomp is a seccomp profile in JSON or "unconfined". When empty,
+	// Docker's default profile is used.
+	Seccomp string `json:"seccomp"`
+	// PidsLimit applies when the sandbox limits don't set one.
+	PidsLimit int64 `json:"pidsLimit"`
+}
+
+// DefaultSecurityProfile runs sandboxes without network access as nobody,
+// with no capabilities and a read-only root filesystem.
+var DefaultSecurityProfile = SecurityProfile{
+	NetworkMode:    "none",
+	User:           "65534:65534",
+	Env:            []string{"HOME=/tmp"},
+	ReadOnlyRootfs: true,
+	Tmpfs: map[string]string{
+		"/tmp": "rw,exec,nosuid,size=65536k,mode=1777",
+	},
+	PidsLimit: 64,
+}
+
+// SecurityConfig holds the profile used for all images and per-image
+// overrides for toolchains that need more access.
+type SecurityConfig struct {
+	Default SecurityProfile
+	Images  map[string]SecurityProfile
+}
+
+var DefaultSecurityConfig = SecurityConfig{Default: DefaultSecurityProfile}
+
+func (c SecurityConfig) profile(image string) SecurityProfile {
+	if profile, ok := c.Images[image]; ok {
+		return profile
+	}
+	return c.Default
+}
+
+// LoadSecurityConfig reads overrides of DefaultSecurityProfile from a JSON
+// file of the form {"default": {...}, "images": {"image": {...}}}. Fields
+// missing in "default" keep their default values, fields missing in an image
+// override keep the values of "default". The seccomp field may also hold a
+// path to the profile file.
+func LoadSecurityConfig(path string) (SecurityConfig, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return SecurityConfig{}, err
+	}
+
+	var file struct {
+		Default json.RawMessage            `json:"default"`
+		Images  map[string]json.RawMessage `json:"images"`
+	}
+	err = json.Unmarshal(data, &file)
+	if err != nil {
+		return SecurityConfig{}, err
+	}
+
+	config := SecurityConfig{
+		Default: DefaultSecurityProfile,
+		Images:  make(map[string]SecurityProfile, len(file.Images)),
+	}
+	if file.Default != nil {
+		config.Default, err = loadSecurityProfile(file.Default, config.Default)
+		if err != nil {
+			return SecurityConfig{}, fmt.Errorf("default: %w", err)
+		}
+	}
+	for image, raw := range file.Images {
+		config.Images[image], err = loadSecurityProfile(raw, config.Default)
+		if err != nil {
+			return SecurityConfig{}, fmt.Errorf("image %s: %w", image, err)
+		}
+	}
+
+	return config, nil
+}
+
+func loadSecurityProfile(data []byte, base SecurityProfile) (SecurityProfile, error) {
+	// Maps are merged by json.Unmarshal, so the base one must not be shared.
+	profile := base
+	profile.Tmpfs = maps.Clone(base.Tmpfs)
+
+	err := json.Unmarshal(data, &profile)
+	if err != nil {
+		return SecurityProfile{}, err
+	}
+
+	if profile.Seccomp != "" && profile.Seccomp != "unconfined" && !strings.HasPrefix(strings.TrimSpace(profile.Seccomp), "{") {
+		seccomp, err := os.ReadFile(profile.Seccomp)
+		if err != nil {
+			return SecurityProfile{}, fmt.Errorf("seccomp: %w", err)
+		}
+		profile.Seccomp = string(seccomp)
+	}
+
+	return profile, nil
+}
+
+func (p SecurityProfile) hostConfig(limits Limits) *container.HostConfig {
+	hostConfig := &container.HostConfig{
+		NetworkMode:    container.NetworkMode(p.NetworkMode),
+		CapDrop:        []string{"ALL"},
+		CapAdd:         p.CapAdd,
+		SecurityOpt:    []string{"no-new-privileges"},
+		ReadonlyRootfs: p.ReadOnlyRootfs,
+		Tmpfs:          make(map[string]string, len(p.Tmpfs)),
+		Resources:      limits.resources(),
+	}
+	maps.Copy(hostConfig.Tmpfs, p.Tmpfs)
+	if p.Seccomp != "" {
+		hostConfig.SecurityOpt = append(hostConfig.SecurityOpt, "seccomp="+p.Seccomp)
+	}
+	if hostConfig.PidsLimit == nil && p.PidsLimit > 0 {
+		pids := p.PidsLimit
+		hostConfig.PidsLimit = &pids
+	}
+	return hostConfig
+}
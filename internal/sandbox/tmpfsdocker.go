@@ -5,33 +5,100 @@ import (
 	"context"
 	"fmt"
 	"io"
+	"path/filepath"
+	"slices"
+	"sync"
 	"time"
 
 	"github.com/docker/docker/api/types/container"
 	docker "github.com/docker/docker/client"
 	"github.com/docker/docker/pkg/stdcopy"
+	"github.com/t3m8ch/coderunner/internal/logging"
 )
 
 type TMPFSDockerManager struct {
 	dockerClient *docker.Client
-	cmd          []string
-	execIDs      map[SandboxID]string
-	execOutputs  map[SandboxID]string
-	outputReady  map[SandboxID]chan struct{}
+	instanceID   string
+	security     SecurityConfig
+
+	mu        sync.Mutex
+	sandboxes map[SandboxID]tmpfsSandbox
+}
+
+// tmpfsSandbox is a container that idles until StartSandbox runs cmd in it as
+// an exec.
+type tmpfsSandbox struct {
+	cmd        []string
+	limits     Limits
+	attachment *tmpfsAttachment
+
+	// Set by StartSandbox.
+	execID    string
+	startedAt time.Time
+	usage     *usageCollector
+	output    *tmpfsOutput
+	guard     *outputGuard
+}
+
+// tmpfsAttachment holds the ends of the pipes handed out by AttachToSandbox,
+// which are connected to the exec once the sandbox starts.
+type tmpfsAttachment struct {
+	stdin  *io.PipeReader
+	stdout *io.PipeWriter
+	stderr *io.PipeWriter
+}
+
+// tmpfsOutput is the output of the exec, logs may only be read after ready
+// is closed.
+type tmpfsOutput struct {
+	ready chan struct{}
+	logs  Logs
+}
+
+func NewTMPFSDockerManager(dockerClient *docker.Client, instanceID string, security SecurityConfig) Manager {
+	return newTMPFSDockerManager(dockerClient, instanceID, security)
 }
 
-func NewTMPFSDockerManager(dockerClient *docker.Client) Manager {
+func newTMPFSDockerManager(dockerClient *docker.Client, instanceID string, security SecurityConfig) *TMPFSDockerManager {
 	return &TMPFSDockerManager{
 		dockerClient: dockerClient,
-		cmd:          make([]string, 0),
-		execIDs:      make(map[SandboxID]string),
-		execOutputs:  make(map[SandboxID]string),
-		outputReady:  make(map[SandboxID]chan struct{}),
+		instanceID:   instanceID,
+		security:     security,
+		sandboxes:    make(map[SandboxID]tmpfsSandbox),
+	}
+}
+
+func (m *TMPFSDockerManager) sandbox(id SandboxID) (tmpfsSandbox, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	sandbox, ok := m.sandboxes[id]
+	if !ok {
+		return tmpfsSandbox{}, fmt.Errorf("unknown sandbox %s", id)
 	}
+	return sandbox, nil
 }
 
-func (m *TMPFSDockerManager) CreateSandbox(ctx context.Context, image string, cmd []string) (SandboxID, error) {
-	m.cmd = cmd
+func (m *TMPFSDockerManager) CreateSandbox(ctx context.Context, image string, cmd []string, limits Limits) (SandboxID, error) {
+	id, err := m.createContainer(ctx, image, limits)
+	if err != nil {
+		return "", err
+	}
+	m.adopt(id, cmd, limits)
+	return id, nil
+}
+
+// createContainer creates and starts an idle container for sandboxes.
+func (m *TMPFSDockerManager) createContainer(ctx context.Context, image string, limits Limits) (SandboxID, error) {
+	profile := m.security.profile(image)
+	hostConfig := profile.hostConfig(limits)
+	hostConfig.Tmpfs[workVolume] = fmt.Sprintf("rw,exec,nosuid,size=%dk,mode=1777", (limits.workDirSize()+1023)/1024)
+	if _, ok := hostConfig.Tmpfs["/tmp"]; !ok {
+		hostConfig.Tmpfs["/tmp"] = "rw,exec,nosuid,size=65536k,mode=1777"
+	}
+	hostConfig.LogConfig = container.LogConfig{
+		Type: "none",
+	}
+
 	resp, err := m.dockerClient.ContainerCreate(
 		ctx,
 		&container.Config{
@@ -42,16 +109,11 @@ func (m *TMPFSDockerManager) CreateSandbox(ctx context.Context, image string, cm
 			StdinOnce:    true,
 			Image:        image,
 			Cmd:          []string{"tail", "-f", "/dev/null"},
+			User:         profile.User,
+			Env:          profile.Env,
+			Labels:       sandboxLabels(ctx, m.instanceID),
 		},
-		&container.HostConfig{
-			Tmpfs: map[string]string{
-				"/app": "rw,exec,nosuid,size=65536k",
-				"/tmp": "rw,exec,nosuid,size=65536k",
-			},
-			LogConfig: container.LogConfig{
-				Type: "none",
-			},
-		},
+		hostConfig,
 		nil,
 		nil,
 		"",
@@ -62,26 +124,70 @@ func (m *TMPFSDockerManager) CreateSandbox(ctx context.Context, image string, cm
 
 	err = m.dockerClient.ContainerStart(ctx, resp.ID, container.StartOptions{})
 	if err != nil {
+		m.dockerClient.ContainerRemove(context.WithoutCancel(ctx), resp.ID, container.RemoveOptions{Force: true})
 		return "", err
 	}
 
 	return resp.ID, nil
 }
 
+// adopt makes a sandbox out of a running idle container.
+func (m *TMPFSDockerManager) adopt(id SandboxID, cmd []string, limits Limits) {
+	m.mu.Lock()
+	m.sandboxes[id] = tmpfsSandbox{
+		cmd:    slices.Clone(cmd),
+		limits: limits,
+	}
+	m.mu.Unlock()
+}
+
+// release forgets the sandbox without touching its container and returns its
+// final state.
+func (m *TMPFSDockerManager) release(id SandboxID) tmpfsSandbox {
+	m.mu.Lock()
+	sandbox := m.sandboxes[id]
+	delete(m.sandboxes, id)
+	m.mu.Unlock()
+
+	sandbox.usage.stop()
+	if sandbox.attachment != nil && sandbox.execID == "" {
+		// Never connected to an exec, so nothing else closes the pipes.
+		sandbox.attachment.stdout.Close()
+		sandbox.attachment.stderr.Close()
+	}
+
+	return sandbox
+}
+
 func (m *TMPFSDockerManager) StartSandbox(ctx context.Context, id SandboxID) error {
+	sandbox, err := m.sandbox(id)
+	if err != nil {
+		return err
+	}
+	if sandbox.execID != "" {
+		return fmt.Errorf("sandbox %s is already started", id)
+	}
+
+	// The idle process, the copies into the sandbox and any earlier execs
+	// have spent CPU time in the container already, which isn't the
+	// command's.
+	cpuBaseline, err := containerCPUTime(ctx, m.dockerClient, id)
+	if err != nil {
+		return err
+	}
+
+	attachment := sandbox.attachment
 	execConfig := container.ExecOptions{
+		AttachStdin:  attachment != nil,
 		AttachStdout: true,
 		AttachStderr: true,
-		Cmd:          m.cmd,
+		Cmd:          sandbox.cmd,
 	}
 	execResp, err := m.dockerClient.ContainerExecCreate(ctx, string(id), execConfig)
 	if err != nil {
 		return err
 	}
 
-	m.execIDs[id] = execResp.ID
-	m.outputReady[id] = make(chan struct{})
-
 	attachResp, err := m.dockerClient.ContainerExecAttach(
 		ctx,
 		execResp.ID,
@@ -91,48 +197,247 @@ func (m *TMPFSDockerManager) StartSandbox(ctx context.Context, id SandboxID) err
 		return err
 	}
 
+	limit := sandbox.limits.Output
+	sandbox.execID = execResp.ID
+	sandbox.startedAt = time.Now()
+	sandbox.usage = collectUsageSince(ctx, m.dockerClient, id, cpuBaseline)
+	sandbox.output = &tmpfsOutput{ready: make(chan struct{})}
+	sandbox.guard = newOutputGuard(limit, killSandbox(ctx, m.dockerClient, id))
+	output, guard := sandbox.output, sandbox.guard
+
+	m.mu.Lock()
+	if _, ok := m.sandboxes[id]; !ok {
+		// Removed while starting.
+		m.mu.Unlock()
+		sandbox.usage.stop()
+		attachResp.Close()
+		return fmt.Errorf("unknown sandbox %s", id)
+	}
+	m.sandboxes[id] = sandbox
+	m.mu.Unlock()
+
+	if attachment != nil {
+		go func() {
+			_, err := io.Copy(attachResp.Conn, attachment.stdin)
+			// The exec may be gone before reading all of its input, the
+			// writer must not be left blocked then.
+			attachment.stdin.CloseWithError(err)
+			attachResp.CloseWrite()
+		}()
+		go func() {
+			_, err := stdcopy.StdCopy(guard.writer(attachment.stdout), guard.writer(attachment.stderr), attachResp.Reader)
+			attachment.stdout.CloseWithError(err)
+			attachment.stderr.CloseWithError(err)
+			// The exec has exited, nothing reads its input anymore.
+			attachment.stdin.CloseWithError(io.ErrClosedPipe)
+			// The output went to the attachment.
+			close(output.ready)
+			attachResp.Close()
+		}()
+		return nil
+	}
+
 	go func() {
-		var buf bytes.Buffer
-		_, err := io.Copy(&buf, attachResp.Reader)
-		if err != nil && err != io.EOF {
-			// Логирование ошибки, если требуется
+		// The exec output is multiplexed, one byte past the limit is kept to
+		// tell that it was exceeded.
+		stdout := &cappedBuffer{limit: limit + 1}
+		stderr := &cappedBuffer{limit: limit + 1}
+		if limit <= 0 {
+			stdout.limit, stderr.limit = -1, -1
+		}
+		_, err := stdcopy.StdCopy(guard.writer(stdout), guard.writer(stderr), attachResp.Reader)
+		if err != nil {
+			logging.FromContext(ctx).Error("Error reading sandbox output", "sandbox_id", id, "error", err)
 		}
-		m.execOutputs[id] = buf.String()
-		close(m.outputReady[id])
+		output.logs = Logs{Stdout: stdout.String(), Stderr: stderr.String()}
+		close(output.ready)
 		attachResp.Close()
 	}()
 
 	return nil
 }
 
-func (m *TMPFSDockerManager) AttachToSandbox(ctx context.Context, id SandboxID) (io.Reader, io.WriteCloser, error) {
-	resp, err := m.dockerClient.ContainerAttach(ctx, id, container.AttachOptions{
-		Stream: true,
-		Stdin:  true,
-		Stdout: true,
-		Stderr: true,
-	})
-	if err != nil {
-		return nil, nil, err
+// AttachToSandbox must be called before StartSandbox, since the streams
+// belong to the exec created on start rather than to the container.
+func (m *TMPFSDockerManager) AttachToSandbox(ctx context.Context, id SandboxID) (*Attachment, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	sandbox, ok := m.sandboxes[id]
+	if !ok {
+		return nil, fmt.Errorf("unknown sandbox %s", id)
+	}
+	if sandbox.execID != "" {
+		return nil, fmt.Errorf("sandbox %s is already started", id)
+	}
+	if sandbox.attachment != nil {
+		return nil, fmt.Errorf("sandbox %s is already attached", id)
+	}
+
+	stdinReader, stdinWriter := io.Pipe()
+	stdoutReader, stdoutWriter := io.Pipe()
+	stderrReader, stderrWriter := io.Pipe()
+	sandbox.attachment = &tmpfsAttachment{
+		stdin:  stdinReader,
+		stdout: stdoutWriter,
+		stderr: stderrWriter,
 	}
-	return resp.Reader, resp.Conn, nil
+	m.sandboxes[id] = sandbox
+
+	return &Attachment{
+		Stdin:  stdinWriter,
+		Stdout: stdoutReader,
+		Stderr: stderrReader,
+		close: func() {
+			stdinWriter.Close()
+			stdoutReader.Close()
+			stderrReader.Close()
+		},
+	}, nil
 }
 
 func (m *TMPFSDockerManager) RemoveSandbox(ctx context.Context, id SandboxID) error {
-	return m.dockerClient.ContainerRemove(ctx, id, container.RemoveOptions{Force: true})
+	err := m.dockerClient.ContainerRemove(ctx, id, container.RemoveOptions{Force: true})
+	if err != nil {
+		return err
+	}
+
+	m.release(id)
+	return nil
+}
+
+// RestartSandbox lets the command of a sandbox that has exited run again in
+// the same container. The work dirs are wiped, except for the keep paths.
+func (m *TMPFSDockerManager) RestartSandbox(ctx context.Context, id SandboxID, keep []string) error {
+	sandbox, err := m.sandbox(id)
+	if err != nil {
+		return err
+	}
+	if sandbox.output == nil {
+		return fmt.Errorf("sandbox %s is not started", id)
+	}
+	select {
+	case <-sandbox.output.ready:
+	default:
+		return fmt.Errorf("sandbox %s is still running", id)
+	}
+	if sandbox.guard.tripped() {
+		return fmt.Errorf("sandbox %s was killed", id)
+	}
+	oomKilled, err := m.oomKilled(ctx, id)
+	if err != nil {
+		return err
+	}
+	if oomKilled {
+		// The mark would stick to every later run.
+		return fmt.Errorf("sandbox %s ran out of memory", id)
+	}
+
+	err = m.wipe(ctx, id, keep)
+	if err != nil {
+		return err
+	}
+
+	m.release(id)
+	m.adopt(id, sandbox.cmd, sandbox.limits)
+	return nil
+}
+
+func (m *TMPFSDockerManager) oomKilled(ctx context.Context, id SandboxID) (bool, error) {
+	inspect, err := m.dockerClient.ContainerInspect(ctx, id)
+	if err != nil {
+		return false, err
+	}
+	return inspect.State != nil && inspect.State.OOMKilled, nil
 }
 
+// wipeScript deletes the files found by the find arguments it is given and
+// everything else the sandbox could pass on through the IPC namespace of the
+// container. It fails if SysV IPC objects are left, e.g. when the image has no
+// ipcrm supporting -a.
+const wipeScript = `set -e
+find "$@" -delete
+[ ! -d /dev/mqueue ] || find /dev/mqueue -mindepth 1 -delete
+ipcrm -a 2>/dev/null || true
+for f in /proc/sysvipc/shm /proc/sysvipc/sem /proc/sysvipc/msg; do
+	[ "$(wc -l < "$f")" -le 1 ]
+done`
+
+// wipe checks that nothing but the idle process is left in the container and
+// deletes everything in the work dirs, in /dev/shm and in the IPC namespace
+// except the keep paths.
+func (m *TMPFSDockerManager) wipe(ctx context.Context, id SandboxID, keep []string) error {
+	top, err := m.dockerClient.ContainerTop(ctx, id, nil)
+	if err != nil {
+		return err
+	}
+	if len(top.Processes) != 1 {
+		return fmt.Errorf("%d processes left in sandbox %s", len(top.Processes)-1, id)
+	}
+
+	cmd := []string{"/bin/sh", "-c", wipeScript, "sh", workVolume, "/tmp", "/dev/shm", "-mindepth", "1"}
+	for _, path := range keep {
+		// Directories on the way to a kept file can't be deleted either.
+		for ; path != "/" && path != "."; path = filepath.Dir(path) {
+			cmd = append(cmd, "!", "-path", path)
+		}
+	}
+
+	exitCode, err := m.exec(ctx, id, cmd)
+	if err != nil {
+		return err
+	}
+	if exitCode != 0 {
+		return fmt.Errorf("wiping sandbox %s: exit code %d", id, exitCode)
+	}
+	return nil
+}
+
+// exec runs cmd in the container as root and returns its exit code. The
+// container has no capabilities, cmd gets them all to clean up after the
+// sandbox user, so it must only be run when no process of the sandbox is left.
+func (m *TMPFSDockerManager) exec(ctx context.Context, id SandboxID, cmd []string) (int, error) {
+	execResp, err := m.dockerClient.ContainerExecCreate(ctx, id, container.ExecOptions{
+		User:         "0",
+		Privileged:   true,
+		AttachStdout: true,
+		AttachStderr: true,
+		Cmd:          cmd,
+	})
+	if err != nil {
+		return 0, err
+	}
+
+	attachResp, err := m.dockerClient.ContainerExecAttach(ctx, execResp.ID, container.ExecAttachOptions{})
+	if err != nil {
+		return 0, err
+	}
+	// The exec has finished once its output ends.
+	io.Copy(io.Discard, attachResp.Reader)
+	attachResp.Close()
+
+	inspect, err := m.dockerClient.ContainerExecInspect(ctx, execResp.ID)
+	if err != nil {
+		return 0, err
+	}
+	return inspect.ExitCode, nil
+}
+
+// CopyFileToSandbox writes the file as root, so that the code run in the
+// sandbox can't replace files kept across restarts. The directory of the file
+// is sticky and writable by everyone, like the work dir itself.
 func (m *TMPFSDockerManager) CopyFileToSandbox(ctx context.Context, id SandboxID, path string, mode int64, data []byte) error {
 	// Convert mode to octal string for chmod
 	modeStr := fmt.Sprintf("%o", mode)
 
 	// Create exec config
 	execConfig := container.ExecOptions{
+		User:         "0",
 		AttachStdin:  true,
 		AttachStdout: false,
 		AttachStderr: false,
 		Tty:          false,
-		Cmd:          []string{"/bin/sh", "-c", "mkdir -p \"$(dirname \"$1\")\" && cat > \"$1\" && chmod $2 \"$1\"", "-", path, modeStr},
+		Cmd:          []string{"/bin/sh", "-c", "mkdir -p -m 1777 \"$(dirname \"$1\")\" && cat > \"$1\" && chmod $2 \"$1\"", "-", path, modeStr},
 		// Cmd: []string{"ls"},
 	}
 
@@ -141,7 +446,6 @@ func (m *TMPFSDockerManager) CopyFileToSandbox(ctx context.Context, id SandboxID
 	if err != nil {
 		return err
 	}
-	fmt.Println("Container exec created")
 
 	// Attach to exec instance with stdin
 	attachResp, err := m.dockerClient.ContainerExecAttach(ctx, execResp.ID, container.ExecAttachOptions{
@@ -151,21 +455,18 @@ func (m *TMPFSDockerManager) CopyFileToSandbox(ctx context.Context, id SandboxID
 		return err
 	}
 	defer attachResp.Close()
-	fmt.Println("Container exec attached")
 
 	// Write the byte array to stdin
 	_, err = io.Copy(attachResp.Conn, bytes.NewReader(data))
 	if err != nil {
 		return err
 	}
-	fmt.Println("Container exec data written")
 
 	// Close stdin to signal EOF
 	err = attachResp.Conn.Close()
 	if err != nil {
 		return err
 	}
-	fmt.Println("Container exec stdin closed")
 
 	// Wait for exec to finish
 	for {
@@ -177,7 +478,7 @@ func (m *TMPFSDockerManager) CopyFileToSandbox(ctx context.Context, id SandboxID
 			if inspect.ExitCode != 0 {
 				return fmt.Errorf("failed to write file: exit code %d", inspect.ExitCode)
 			}
-			fmt.Println("Container exec finished")
+			logging.FromContext(ctx).Debug("File copied to sandbox", "sandbox_id", id, "path", path)
 			return nil
 		}
 		time.Sleep(100 * time.Millisecond)
@@ -214,37 +515,96 @@ func (m *TMPFSDockerManager) LoadFileFromSandbox(ctx context.Context, id Sandbox
 	return stdout.Bytes(), nil
 }
 
-func (m *TMPFSDockerManager) WaitSandbox(ctx context.Context, id SandboxID) (StatusCode, error) {
-	execID, ok := m.execIDs[id]
-	if !ok {
-		return -1, fmt.Errorf("no exec ID found for container %s", id)
+func (m *TMPFSDockerManager) WaitSandbox(ctx context.Context, id SandboxID) (WaitResult, error) {
+	sandbox, err := m.sandbox(id)
+	if err != nil {
+		return WaitResult{StatusCode: -1}, err
+	}
+	if sandbox.execID == "" {
+		return WaitResult{StatusCode: -1}, fmt.Errorf("sandbox %s is not started", id)
+	}
+
+	var deadline time.Time
+	if sandbox.limits.WallTime > 0 {
+		deadline = sandbox.startedAt.Add(sandbox.limits.WallTime)
 	}
 
+	killed := false
 	for {
-		execInspect, err := m.dockerClient.ContainerExecInspect(ctx, execID)
+		execInspect, err := m.dockerClient.ContainerExecInspect(ctx, sandbox.execID)
 		if err != nil {
-			return -1, err
+			return WaitResult{StatusCode: -1}, err
 		}
 		if !execInspect.Running {
-			return int64(execInspect.ExitCode), nil
+			return m.waitResult(ctx, id, sandbox, int64(execInspect.ExitCode), killed)
+		}
+		if !killed && !deadline.IsZero() && time.Now().After(deadline) {
+			// An exec can't be killed on its own, but the container only
+			// exists to run it.
+			err = m.dockerClient.ContainerKill(ctx, id, "KILL")
+			if err != nil {
+				return WaitResult{StatusCode: -1}, err
+			}
+			killed = true
 		}
 		time.Sleep(100 * time.Millisecond) // Wait a short time before checking again
 	}
 }
 
-func (m *TMPFSDockerManager) ReadLogsFromSandbox(ctx context.Context, id SandboxID) (string, error) {
-	readyCh, ok := m.outputReady[id]
-	if !ok {
-		return "", fmt.Errorf("no output ready for container %s", id)
+func (m *TMPFSDockerManager) waitResult(
+	ctx context.Context,
+	id SandboxID,
+	sandbox tmpfsSandbox,
+	statusCode StatusCode,
+	timedOut bool,
+) (WaitResult, error) {
+	cpuTime, peakMemory := sandbox.usage.stop()
+	result := WaitResult{
+		StatusCode: statusCode,
+		Signal:     signalFromStatusCode(statusCode),
+		WallTime:   time.Since(sandbox.startedAt),
+		CPUTime:    cpuTime,
+		PeakMemory: peakMemory,
+	}
+	// The container outlives the exec, so the CPU time it has spent is exact
+	// now, unlike the samples taken while the exec ran.
+	if total, err := containerCPUTime(ctx, m.dockerClient, id); err == nil {
+		result.CPUTime = max(result.CPUTime, total-sandbox.usage.cpuBaseline)
+	}
+	if sandbox.guard.tripped() {
+		result.LimitExceeded = OutputLimitExceeded
+		return result, nil
+	}
+	if timedOut {
+		result.LimitExceeded = WallTimeLimitExceeded
+		return result, nil
+	}
+
+	oomKilled, err := m.oomKilled(ctx, id)
+	if err != nil {
+		return result, err
+	}
+	result.LimitExceeded = sandbox.limits.limitExceeded(statusCode, oomKilled, result.CPUTime)
+	return result, nil
+}
+
+func (m *TMPFSDockerManager) ReadLogsFromSandbox(ctx context.Context, id SandboxID) (Logs, error) {
+	sandbox, err := m.sandbox(id)
+	if err != nil {
+		return Logs{}, err
+	}
+	if sandbox.output == nil {
+		return Logs{}, fmt.Errorf("sandbox %s is not started", id)
 	}
 	select {
-	case <-readyCh:
-		output, ok := m.execOutputs[id]
-		if !ok {
-			return "", fmt.Errorf("no output for container %s", id)
-		}
-		return output, nil
+	case <-sandbox.output.ready:
+		logs := sandbox.output.logs
+		return sandbox.limits.truncateLogs([]byte(logs.Stdout), []byte(logs.Stderr))
 	case <-ctx.Done():
-		return "", ctx.Err()
+		return Logs{}, ctx.Err()
 	}
 }
+
+func (m *TMPFSDockerManager) ImageDigest(ctx context.Context, image string) (string, error) {
+	return imageDigest(ctx, m.dockerClient, image)
+}
@@ -0,0 +1,514 @@
+package sandbox
+
+import (
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/docker/docker/api/types/container"
+	docker "github.com/docker/docker/client"
+)
+
+// fakeDocker implements the part of the Docker API that TMPFSDockerManager
+// and PoolManager use. An exec writes its command to stdout, followed by its
+// stdin.
+type fakeDocker struct {
+	mu         sync.Mutex
+	containers map[string]bool
+	execs      map[string]*fakeExec
+	removed    map[string]bool
+	oomKilled  map[string]bool
+	failCreate bool
+	nextID     int
+}
+
+type fakeExec struct {
+	container string
+	options   container.ExecOptions
+	running   bool
+}
+
+func newFakeDocker() *fakeDocker {
+	return &fakeDocker{
+		containers: make(map[string]bool),
+		execs:      make(map[string]*fakeExec),
+		removed:    make(map[string]bool),
+		oomKilled:  make(map[string]bool),
+	}
+}
+
+// execsIn returns the commands run in the container, in order.
+func (d *fakeDocker) execsIn(id string) []container.ExecOptions {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	var ids []string
+	for execID, exec := range d.execs {
+		if exec.container == id {
+			ids = append(ids, execID)
+		}
+	}
+	slices.SortFunc(ids, func(a, b string) int {
+		x, _ := strconv.Atoi(strings.TrimPrefix(a, "exec"))
+		y, _ := strconv.Atoi(strings.TrimPrefix(b, "exec"))
+		return x - y
+	})
+	options := make([]container.ExecOptions, 0, len(ids))
+	for _, id := range ids {
+		options = append(options, d.execs[id].options)
+	}
+	return options
+}
+
+func (d *fakeDocker) wasRemoved(id string) bool {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return d.removed[id]
+}
+
+func (d *fakeDocker) newID(prefix string) string {
+	d.nextID++
+	return prefix + strconv.Itoa(d.nextID)
+}
+
+func (d *fakeDocker) handler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("POST /{version}/containers/create", func(w http.ResponseWriter, r *http.Request) {
+		d.mu.Lock()
+		if d.failCreate {
+			d.mu.Unlock()
+			writeJSON(w, http.StatusInternalServerError, map[string]string{"message": "create failed"})
+			return
+		}
+		id := d.newID("container")
+		d.containers[id] = true
+		d.mu.Unlock()
+		writeJSON(w, http.StatusCreated, container.CreateResponse{ID: id})
+	})
+	mux.HandleFunc("POST /{version}/containers/{id}/start", func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusNoContent)
+	})
+	mux.HandleFunc("POST /{version}/containers/{id}/kill", func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusNoContent)
+	})
+	mux.HandleFunc("POST /{version}/containers/{id}/update", func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, http.StatusOK, container.UpdateResponse{})
+	})
+	mux.HandleFunc("GET /{version}/containers/{id}/json", func(w http.ResponseWriter, r *http.Request) {
+		d.mu.Lock()
+		oomKilled := d.oomKilled[r.PathValue("id")]
+		d.mu.Unlock()
+		writeJSON(w, http.StatusOK, map[string]any{
+			"Id":    r.PathValue("id"),
+			"State": map[string]any{"Running": true, "OOMKilled": oomKilled},
+		})
+	})
+	mux.HandleFunc("GET /{version}/containers/{id}/top", func(w http.ResponseWriter, r *http.Request) {
+		// Only the idle process, the execs of the fake end with their output.
+		writeJSON(w, http.StatusOK, container.ContainerTopOKBody{
+			Titles:    []string{"PID", "CMD"},
+			Processes: [][]string{{"1", "tail -f /dev/null"}},
+		})
+	})
+	mux.HandleFunc("GET /{version}/containers/{id}/stats", func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, http.StatusOK, container.StatsResponse{})
+	})
+	mux.HandleFunc("DELETE /{version}/containers/{id}", func(w http.ResponseWriter, r *http.Request) {
+		d.mu.Lock()
+		delete(d.containers, r.PathValue("id"))
+		d.removed[r.PathValue("id")] = true
+		d.mu.Unlock()
+		w.WriteHeader(http.StatusNoContent)
+	})
+	mux.HandleFunc("POST /{version}/containers/{id}/exec", func(w http.ResponseWriter, r *http.Request) {
+		var options container.ExecOptions
+		if err := json.NewDecoder(r.Body).Decode(&options); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		d.mu.Lock()
+		id := d.newID("exec")
+		d.execs[id] = &fakeExec{container: r.PathValue("id"), options: options, running: true}
+		d.mu.Unlock()
+		writeJSON(w, http.StatusCreated, container.ExecCreateResponse{ID: id})
+	})
+	mux.HandleFunc("GET /{version}/exec/{id}/json", func(w http.ResponseWriter, r *http.Request) {
+		d.mu.Lock()
+		exec := d.execs[r.PathValue("id")]
+		running := exec.running
+		d.mu.Unlock()
+		writeJSON(w, http.StatusOK, container.ExecInspect{ExecID: r.PathValue("id"), Running: running})
+	})
+	mux.HandleFunc("POST /{version}/exec/{id}/start", d.startExec)
+	return mux
+}
+
+func (d *fakeDocker) startExec(w http.ResponseWriter, r *http.Request) {
+	d.mu.Lock()
+	exec := d.execs[r.PathValue("id")]
+	d.mu.Unlock()
+
+	conn, _, err := w.(http.Hijacker).Hijack()
+	if err != nil {
+		return
+	}
+	defer conn.Close()
+	io.WriteString(conn, "HTTP/1.1 101 UPGRADED\r\n"+
+		"Content-Type: application/vnd.docker.multiplexed-stream\r\n"+
+		"Connection: Upgrade\r\n"+
+		"Upgrade: tcp\r\n\r\n")
+
+	output := strings.Join(exec.options.Cmd, " ") + "\n"
+	if exec.options.AttachStdin {
+		input, _ := io.ReadAll(conn)
+		output += string(input)
+	}
+	header := make([]byte, 8)
+	header[0] = 1 // stdout
+	binary.BigEndian.PutUint32(header[4:], uint32(len(output)))
+	conn.Write(append(header, output...))
+
+	d.mu.Lock()
+	exec.running = false
+	d.mu.Unlock()
+}
+
+func writeJSON(w http.ResponseWriter, status int, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
+}
+
+func newFakeTMPFSDockerManager(t *testing.T) (*TMPFSDockerManager, *fakeDocker) {
+	fake := newFakeDocker()
+	server := httptest.NewServer(fake.handler())
+	t.Cleanup(server.Close)
+
+	dockerClient, err := docker.NewClientWithOpts(
+		docker.WithHost("tcp://"+server.Listener.Addr().String()),
+		docker.WithHTTPClient(server.Client()),
+		docker.WithVersion("1.47"),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { dockerClient.Close() })
+
+	return newTMPFSDockerManager(dockerClient, "test", DefaultSecurityConfig), fake
+}
+
+func TestTMPFSDockerManagerConcurrentSandboxes(t *testing.T) {
+	m, fake := newFakeTMPFSDockerManager(t)
+	ctx := context.Background()
+
+	const count = 16
+	ids := make([]SandboxID, count)
+	var wg sync.WaitGroup
+	for i := range count {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			id, err := runFakeSandbox(ctx, m, i)
+			if err != nil {
+				t.Errorf("sandbox %d: %v", i, err)
+			}
+			ids[i] = id
+		}()
+	}
+	wg.Wait()
+
+	m.mu.Lock()
+	left := len(m.sandboxes)
+	m.mu.Unlock()
+	if left != 0 {
+		t.Errorf("%d sandboxes left after removal", left)
+	}
+
+	fake.mu.Lock()
+	defer fake.mu.Unlock()
+	for i, id := range ids {
+		if id != "" && !fake.removed[id] {
+			t.Errorf("container of sandbox %d was not removed", i)
+		}
+	}
+	for execID, exec := range fake.execs {
+		i := slices.Index(ids, exec.container)
+		want := fmt.Sprintf("run %d", i)
+		if got := strings.Join(exec.options.Cmd, " "); got != want {
+			t.Errorf("exec %s in the container of sandbox %d runs %q, want %q", execID, i, got, want)
+		}
+	}
+}
+
+// runFakeSandbox runs a sandbox through its whole life and checks that its
+// output is its own.
+func runFakeSandbox(ctx context.Context, m *TMPFSDockerManager, i int) (SandboxID, error) {
+	id, err := m.CreateSandbox(ctx, "image", []string{"run", strconv.Itoa(i)}, Limits{})
+	if err != nil {
+		return "", err
+	}
+	defer m.RemoveSandbox(ctx, id)
+
+	attachment, err := m.AttachToSandbox(ctx, id)
+	if err != nil {
+		return id, err
+	}
+	defer attachment.Close()
+
+	err = m.StartSandbox(ctx, id)
+	if err != nil {
+		return id, err
+	}
+
+	go func() {
+		fmt.Fprintf(attachment.Stdin, "input %d\n", i)
+		attachment.Stdin.Close()
+	}()
+	output, err := io.ReadAll(attachment.Stdout)
+	if err != nil {
+		return id, err
+	}
+
+	result, err := m.WaitSandbox(ctx, id)
+	if err != nil {
+		return id, err
+	}
+	if result.StatusCode != 0 {
+		return id, fmt.Errorf("status code %d", result.StatusCode)
+	}
+
+	want := fmt.Sprintf("run %d\ninput %d\n", i, i)
+	if string(output) != want {
+		return id, fmt.Errorf("output %q, want %q", output, want)
+	}
+	return id, nil
+}
+
+func TestTMPFSDockerManagerRemoveWhileStarting(t *testing.T) {
+	m, fake := newFakeTMPFSDockerManager(t)
+	ctx := context.Background()
+
+	var wg sync.WaitGroup
+	for i := range 16 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+
+			id, err := m.CreateSandbox(ctx, "image", []string{"run", strconv.Itoa(i)}, Limits{})
+			if err != nil {
+				t.Errorf("sandbox %d: %v", i, err)
+				return
+			}
+			attachment, err := m.AttachToSandbox(ctx, id)
+			if err != nil {
+				t.Errorf("sandbox %d: %v", i, err)
+				return
+			}
+			defer attachment.Close()
+			attachment.Stdin.Close()
+
+			started := make(chan error)
+			go func() { started <- m.StartSandbox(ctx, id) }()
+			err = m.RemoveSandbox(ctx, id)
+			if err != nil {
+				t.Errorf("sandbox %d: %v", i, err)
+			}
+			// Either way the sandbox is gone.
+			<-started
+
+			// Whether or not the exec was started, the output must end.
+			io.ReadAll(attachment.Stdout)
+			io.ReadAll(attachment.Stderr)
+			if !fake.wasRemoved(id) {
+				t.Errorf("container of sandbox %d was not removed", i)
+			}
+		}()
+	}
+	wg.Wait()
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if len(m.sandboxes) != 0 {
+		t.Errorf("%d sandboxes left after removal", len(m.sandboxes))
+	}
+}
+
+func TestTMPFSDockerManagerRestart(t *testing.T) {
+	m, fake := newFakeTMPFSDockerManager(t)
+	ctx := context.Background()
+
+	id, err := m.CreateSandbox(ctx, "image", []string{"run"}, Limits{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer m.RemoveSandbox(ctx, id)
+
+	keep := WorkDir + "/solution"
+	for run := range 3 {
+		if run > 0 {
+			err = m.RestartSandbox(ctx, id, []string{keep})
+			if err != nil {
+				t.Fatalf("run %d: %v", run, err)
+			}
+		}
+		logs, err := runStartedSandbox(ctx, m, id)
+		if err != nil {
+			t.Fatalf("run %d: %v", run, err)
+		}
+		if logs.Stdout != "run\n" {
+			t.Errorf("run %d: output %q, want %q", run, logs.Stdout, "run\n")
+		}
+	}
+
+	var runs, wipes int
+	for _, exec := range fake.execsIn(id) {
+		switch {
+		case slices.Equal(exec.Cmd, []string{"run"}):
+			runs++
+		case exec.User == "0" && slices.Contains(exec.Cmd, keep):
+			wipes++
+		default:
+			t.Errorf("unexpected exec %q", exec.Cmd)
+		}
+	}
+	if runs != 3 || wipes != 2 {
+		t.Errorf("%d runs and %d wipes, want 3 and 2", runs, wipes)
+	}
+
+	// The mark sticks to the container, which can't be reused then.
+	fake.mu.Lock()
+	fake.oomKilled[id] = true
+	fake.mu.Unlock()
+	err = m.RestartSandbox(ctx, id, nil)
+	if err == nil {
+		t.Error("restarted an OOM killed sandbox")
+	}
+}
+
+func newFakePoolManager(t *testing.T, config PoolConfig) (*PoolManager, *fakeDocker) {
+	tmpfs, fake := newFakeTMPFSDockerManager(t)
+	return NewPoolManager(tmpfs.dockerClient, "test", DefaultSecurityConfig, config), fake
+}
+
+func TestPoolManagerReuse(t *testing.T) {
+	m, fake := newFakePoolManager(t, PoolConfig{Size: 1, MaxUses: 3})
+	ctx := context.Background()
+	limits := Limits{Memory: 64 << 20}
+
+	err := m.Warm(ctx, "image")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The pool is not topped up anymore, so returned containers are kept.
+	fake.mu.Lock()
+	fake.failCreate = true
+	fake.mu.Unlock()
+
+	use := func() SandboxID {
+		t.Helper()
+		id, err := m.CreateSandbox(ctx, "image", []string{"run"}, limits)
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, err = runStartedSandbox(ctx, m, id)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return id
+	}
+	idle := func() []*pooledContainer {
+		m.mu.Lock()
+		defer m.mu.Unlock()
+		return slices.Clone(m.idle["image"])
+	}
+
+	first := use()
+	err = m.RemoveSandbox(ctx, first)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if c := idle(); len(c) != 1 || c[0].id != first || fake.wasRemoved(first) {
+		t.Fatalf("container %s was not returned to the pool", first)
+	}
+
+	// A restart counts as a use, the third one exceeds MaxUses.
+	second := use()
+	if second != first {
+		t.Fatalf("got container %s instead of the pooled %s", second, first)
+	}
+	err = m.RestartSandbox(ctx, second, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = runStartedSandbox(ctx, m, second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = m.RestartSandbox(ctx, second, nil)
+	if !errors.Is(err, ErrRestartNotSupported) {
+		t.Fatalf("restarting an expired container: %v", err)
+	}
+	err = m.RemoveSandbox(ctx, second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(idle()) != 0 || !fake.wasRemoved(second) {
+		t.Errorf("expired container %s was kept", second)
+	}
+
+	m.manager.mu.Lock()
+	defer m.manager.mu.Unlock()
+	if len(m.manager.sandboxes) != 0 {
+		t.Errorf("%d sandboxes left after removal", len(m.manager.sandboxes))
+	}
+}
+
+func TestPoolManagerDiscardsOOMKilled(t *testing.T) {
+	m, fake := newFakePoolManager(t, PoolConfig{Size: 1})
+	ctx := context.Background()
+
+	id, err := m.CreateSandbox(ctx, "image", []string{"run"}, Limits{Memory: 64 << 20})
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = runStartedSandbox(ctx, m, id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	fake.mu.Lock()
+	fake.oomKilled[id] = true
+	fake.mu.Unlock()
+
+	err = m.RemoveSandbox(ctx, id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !fake.wasRemoved(id) {
+		t.Errorf("OOM killed container %s was kept", id)
+	}
+}
+
+// runStartedSandbox starts the sandbox and returns its output once it exits.
+func runStartedSandbox(ctx context.Context, m Manager, id SandboxID) (Logs, error) {
+	err := m.StartSandbox(ctx, id)
+	if err != nil {
+		return Logs{}, err
+	}
+	result, err := m.WaitSandbox(ctx, id)
+	if err != nil {
+		return Logs{}, err
+	}
+	if result.StatusCode != 0 {
+		return Logs{}, fmt.Errorf("status code %d", result.StatusCode)
+	}
+	return m.ReadLogsFromSandbox(ctx, id)
+}
@@ -0,0 +1,131 @@
+package sandbox
+
+import (
+	"context"
+	"errors"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
+)
+
+var tracer = otel.Tracer("github.com/t3m8ch/coderunner/internal/sandbox")
+
+// TracingDecorator records a span for every call.
+type TracingDecorator struct {
+	manager Manager
+}
+
+func NewTracingDecorator(manager Manager) Manager {
+	return &TracingDecorator{manager: manager}
+}
+
+func startSpan(ctx context.Context, method string, attrs ...attribute.KeyValue) (context.Context, trace.Span) {
+	return tracer.Start(ctx, "sandbox."+method, trace.WithAttributes(attrs...))
+}
+
+func endSpan(span trace.Span, err error) {
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	}
+	span.End()
+}
+
+func sandboxAttr(id SandboxID) attribute.KeyValue {
+	return attribute.String("sandbox.id", id)
+}
+
+func (d *TracingDecorator) CreateSandbox(ctx context.Context, image string, cmd []string, limits Limits) (SandboxID, error) {
+	ctx, span := startSpan(ctx, "CreateSandbox", attribute.String("sandbox.image", image))
+	id, err := d.manager.CreateSandbox(ctx, image, cmd, limits)
+	span.SetAttributes(sandboxAttr(id))
+	endSpan(span, err)
+	return id, err
+}
+
+func (d *TracingDecorator) StartSandbox(ctx context.Context, id SandboxID) error {
+	ctx, span := startSpan(ctx, "StartSandbox", sandboxAttr(id))
+	err := d.manager.StartSandbox(ctx, id)
+	endSpan(span, err)
+	return err
+}
+
+func (d *TracingDecorator) RestartSandbox(ctx context.Context, id SandboxID, keep []string) error {
+	ctx, span := startSpan(ctx, "RestartSandbox", sandboxAttr(id))
+	err := d.manager.RestartSandbox(ctx, id, keep)
+	// Some managers never support restarting, which isn't a failure.
+	failure := err
+	if errors.Is(err, ErrRestartNotSupported) {
+		failure = nil
+	}
+	endSpan(span, failure)
+	return err
+}
+
+func (d *TracingDecorator) AttachToSandbox(ctx context.Context, id SandboxID) (*Attachment, error) {
+	ctx, span := startSpan(ctx, "AttachToSandbox", sandboxAttr(id))
+	attachment, err := d.manager.AttachToSandbox(ctx, id)
+	endSpan(span, err)
+	return attachment, err
+}
+
+func (d *TracingDecorator) RemoveSandbox(ctx context.Context, id SandboxID) error {
+	ctx, span := startSpan(ctx, "RemoveSandbox", sandboxAttr(id))
+	err := d.manager.RemoveSandbox(ctx, id)
+	endSpan(span, err)
+	return err
+}
+
+func (d *TracingDecorator) CopyFileToSandbox(ctx context.Context, id SandboxID, path string, mode int64, data []byte) error {
+	ctx, span := startSpan(ctx, "CopyFileToSandbox",
+		sandboxAttr(id),
+		attribute.String("file.path", path),
+		attribute.Int("file.size", len(data)),
+	)
+	err := d.manager.CopyFileToSandbox(ctx, id, path, mode, data)
+	endSpan(span, err)
+	return err
+}
+
+func (d *TracingDecorator) LoadFileFromSandbox(ctx context.Context, id SandboxID, path string) ([]byte, error) {
+	ctx, span := startSpan(ctx, "LoadFileFromSandbox", sandboxAttr(id), attribute.String("file.path", path))
+	data, err := d.manager.LoadFileFromSandbox(ctx, id, path)
+	span.SetAttributes(attribute.Int("file.size", len(data)))
+	endSpan(span, err)
+	return data, err
+}
+
+func (d *TracingDecorator) WaitSandbox(ctx context.Context, id SandboxID) (WaitResult, error) {
+	ctx, span := startSpan(ctx, "WaitSandbox", sandboxAttr(id))
+	result, err := d.manager.WaitSandbox(ctx, id)
+	if err == nil {
+		span.SetAttributes(
+			attribute.Int64("sandbox.exit_code", result.StatusCode),
+			attribute.String("sandbox.limit_exceeded", string(result.LimitExceeded)),
+			attribute.Int64("sandbox.wall_time_ms", result.WallTime.Milliseconds()),
+		)
+	}
+	endSpan(span, err)
+	return result, err
+}
+
+func (d *TracingDecorator) ReadLogsFromSandbox(ctx context.Context, id SandboxID) (Logs, error) {
+	ctx, span := startSpan(ctx, "ReadLogsFromSandbox", sandboxAttr(id))
+	logs, err := d.manager.ReadLogsFromSandbox(ctx, id)
+	// Truncated output is reported along with the logs, it isn't a failure.
+	failure := err
+	if errors.Is(err, ErrOutputLimitExceeded) {
+		failure = nil
+	}
+	endSpan(span, failure)
+	return logs, err
+}
+
+func (d *TracingDecorator) ImageDigest(ctx context.Context, image string) (string, error) {
+	ctx, span := startSpan(ctx, "ImageDigest", attribute.String("sandbox.image", image))
+	digest, err := d.manager.ImageDigest(ctx, image)
+	endSpan(span, err)
+	return digest, err
+}
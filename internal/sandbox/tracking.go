@@ -0,0 +1,105 @@
+package sandbox
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+)
+
+// TrackingDecorator remembers the sandboxes created through it until they are
+// removed, so that leftovers can be cleaned up on shutdown.
+type TrackingDecorator struct {
+	manager Manager
+
+	mu        sync.Mutex
+	sandboxes map[SandboxID]struct{}
+}
+
+func NewTrackingDecorator(manager Manager) *TrackingDecorator {
+	return &TrackingDecorator{
+		manager:   manager,
+		sandboxes: make(map[SandboxID]struct{}),
+	}
+}
+
+// RemoveAll removes every sandbox that was created but not removed yet and
+// returns how many were removed.
+func (d *TrackingDecorator) RemoveAll(ctx context.Context) (int, error) {
+	d.mu.Lock()
+	ids := make([]SandboxID, 0, len(d.sandboxes))
+	for id := range d.sandboxes {
+		ids = append(ids, id)
+	}
+	d.mu.Unlock()
+
+	var errs []error
+	removed := 0
+	for _, id := range ids {
+		if err := d.RemoveSandbox(ctx, id); err != nil {
+			errs = append(errs, fmt.Errorf("sandbox %s: %w", id, err))
+			continue
+		}
+		removed++
+	}
+
+	return removed, errors.Join(errs...)
+}
+
+func (d *TrackingDecorator) CreateSandbox(ctx context.Context, image string, cmd []string, limits Limits) (SandboxID, error) {
+	id, err := d.manager.CreateSandbox(ctx, image, cmd, limits)
+	if err != nil {
+		return "", err
+	}
+
+	d.mu.Lock()
+	d.sandboxes[id] = struct{}{}
+	d.mu.Unlock()
+
+	return id, nil
+}
+
+func (d *TrackingDecorator) StartSandbox(ctx context.Context, id SandboxID) error {
+	return d.manager.StartSandbox(ctx, id)
+}
+
+func (d *TrackingDecorator) RestartSandbox(ctx context.Context, id SandboxID, keep []string) error {
+	return d.manager.RestartSandbox(ctx, id, keep)
+}
+
+func (d *TrackingDecorator) AttachToSandbox(ctx context.Context, id SandboxID) (*Attachment, error) {
+	return d.manager.AttachToSandbox(ctx, id)
+}
+
+func (d *TrackingDecorator) RemoveSandbox(ctx context.Context, id SandboxID) error {
+	err := d.manager.RemoveSandbox(ctx, id)
+	if err != nil {
+		return err
+	}
+
+	d.mu.Lock()
+	delete(d.sandboxes, id)
+	d.mu.Unlock()
+
+	return nil
+}
+
+func (d *TrackingDecorator) CopyFileToSandbox(ctx context.Context, id SandboxID, path string, mode int64, data []byte) error {
+	return d.manager.CopyFileToSandbox(ctx, id, path, mode, data)
+}
+
+func (d *TrackingDecorator) LoadFileFromSandbox(ctx context.Context, id SandboxID, path string) ([]byte, error) {
+	return d.manager.LoadFileFromSandbox(ctx, id, path)
+}
+
+func (d *TrackingDecorator) WaitSandbox(ctx context.Context, id SandboxID) (WaitResult, error) {
+	return d.manager.WaitSandbox(ctx, id)
+}
+
+func (d *TrackingDecorator) ReadLogsFromSandbox(ctx context.Context, id SandboxID) (Logs, error) {
+	return d.manager.ReadLogsFromSandbox(ctx, id)
+}
+
+func (d *TrackingDecorator) ImageDigest(ctx context.Context, image string) (string, error) {
+	return d.manager.ImageDigest(ctx, image)
+}
@@ -0,0 +1,119 @@
+package sandbox
+
+import (
+	"context"
+	"encoding/json"
+	"sync"
+	"time"
+
+	"github.com/docker/docker/api/types/container"
+	docker "github.com/docker/docker/client"
+)
+
+// Exit codes above this value mean the process was terminated by signal
+// (StatusCode - signalStatusBase), following the shell convention Docker uses.
+const signalStatusBase = 128
+
+// usageCollector samples container stats while a sandbox runs. Docker only
+// reports stats about once a second and drops them when the container exits,
+// so CPU time and peak memory of very short runs are best effort.
+type usageCollector struct {
+	cancel context.CancelFunc
+	done   chan struct{}
+	// cpuBaseline is the CPU time the container had spent before.
+	cpuBaseline time.Duration
+
+	mu         sync.Mutex
+	cpuTime    time.Duration
+	peakMemory int64
+}
+
+func collectUsage(ctx context.Context, dockerClient *docker.Client, id SandboxID) *usageCollector {
+	return collectUsageSince(ctx, dockerClient, id, 0)
+}
+
+// collectUsageSince is collectUsage for a container that has already spent
+// cpuBaseline, e.g. running other processes than the sandboxed one. The peak memory of earlier runs can't be told
+// apart on cgroup v1, where the kernel reports the maximum itself.
+func collectUsageSince(ctx context.Context, dockerClient *docker.Client, id SandboxID, cpuBaseline time.Duration) *usageCollector {
+	ctx, cancel := context.WithCancel(ctx)
+	c := &usageCollector{
+		cancel:      cancel,
+		done:        make(chan struct{}),
+		cpuBaseline: cpuBaseline,
+	}
+
+	go func() {
+		defer close(c.done)
+
+		stats, err := dockerClient.ContainerStats(ctx, id, true)
+		if err != nil {
+			return
+		}
+		defer stats.Body.Close()
+
+		decoder := json.NewDecoder(stats.Body)
+		for {
+			var sample container.StatsResponse
+			if err := decoder.Decode(&sample); err != nil {
+				return
+			}
+			c.record(sample)
+		}
+	}()
+
+	return c
+}
+
+func (c *usageCollector) record(sample container.StatsResponse) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	cpuTime := time.Duration(sample.CPUStats.CPUUsage.TotalUsage)
+	if cpuTime > c.cpuTime {
+		c.cpuTime = cpuTime
+	}
+
+	memory := int64(max(sample.MemoryStats.Usage, sample.MemoryStats.MaxUsage))
+	if memory > c.peakMemory {
+		c.peakMemory = memory
+	}
+}
+
+// stop ends sampling and returns the collected usage. It is safe to call on a
+// nil collector and more than once.
+func (c *usageCollector) stop() (time.Duration, int64) {
+	if c == nil {
+		return 0, 0
+	}
+
+	c.cancel()
+	<-c.done
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return max(c.cpuTime-c.cpuBaseline, 0), c.peakMemory
+}
+
+// containerCPUTime returns the CPU time the container has spent so far.
+func containerCPUTime(ctx context.Context, dockerClient *docker.Client, id SandboxID) (time.Duration, error) {
+	stats, err := dockerClient.ContainerStatsOneShot(ctx, id)
+	if err != nil {
+		return 0, err
+	}
+	defer stats.Body.Close()
+
+	var sample container.StatsResponse
+	err = json.NewDecoder(stats.Body).Decode(&sample)
+	if err != nil {
+		return 0, err
+	}
+	return time.Duration(sample.CPUStats.CPUUsage.TotalUsage), nil
+}
+
+func signalFromStatusCode(statusCode StatusCode) int {
+	if statusCode > signalStatusBase {
+		return int(statusCode - signalStatusBase)
+	}
+	return 0
+}
@@ -0,0 +1,26 @@
+package taskstore
+
+import (
+	"context"
+	"errors"
+
+	"github.com/t3m8ch/coderunner/internal/model"
+)
+
+var (
+	ErrNotFound = errors.New("task not found")
+	ErrExists   = errors.New("task already exists")
+)
+
+type Store interface {
+	// Create saves a new task, or returns ErrExists if there is one with its
+	// ID already.
+	Create(ctx context.Context, task model.Task) error
+	Save(ctx context.Context, task model.Task) error
+	Get(ctx context.Context, id string) (model.Task, error)
+	// List returns up to limit most recently created tasks, newest first.
+	List(ctx context.Context, limit int) ([]model.Task, error)
+	// ListByTestsLocation returns the tasks tested against the given tests
+	// file, in no particular order.
+	ListByTestsLocation(ctx context.Context, location model.FileLocation) ([]model.Task, error)
+}
@@ -0,0 +1,137 @@
+package taskstore
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+	"github.com/t3m8ch/coderunner/internal/model"
+)
+
+const (
+	recentTasksKey = "tasks:recent"
+	maxRecentTasks = 10000
+)
+
+type RedisStore struct {
+	client *redis.Client
+	ttl    time.Duration
+}
+
+// NewRedisStore returns a store keeping each task as JSON under task:<id>.
+// A zero ttl keeps tasks forever.
+func NewRedisStore(client *redis.Client, ttl time.Duration) *RedisStore {
+	return &RedisStore{client: client, ttl: ttl}
+}
+
+func taskKey(id string) string {
+	return fmt.Sprintf("task:%s", id)
+}
+
+func testsLocationKey(location model.FileLocation) string {
+	return fmt.Sprintf("tasks:tests:%s/%s", location.BucketName, location.ObjectName)
+}
+
+func (s *RedisStore) Create(ctx context.Context, task model.Task) error {
+	jsonBytes, err := json.Marshal(task)
+	if err != nil {
+		return err
+	}
+
+	created, err := s.client.SetNX(ctx, taskKey(task.ID), string(jsonBytes), s.ttl).Result()
+	if err != nil {
+		return err
+	}
+	if !created {
+		return ErrExists
+	}
+	// Adds the task to the indexes.
+	return s.Save(ctx, task)
+}
+
+func (s *RedisStore) Save(ctx context.Context, task model.Task) error {
+	jsonBytes, err := json.Marshal(task)
+	if err != nil {
+		return err
+	}
+
+	_, err = s.client.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+		pipe.Set(ctx, taskKey(task.ID), string(jsonBytes), s.ttl)
+		pipe.ZAddNX(ctx, recentTasksKey, redis.Z{
+			Score:  float64(task.CreatedAt.UnixMilli()),
+			Member: task.ID,
+		})
+		pipe.ZRemRangeByRank(ctx, recentTasksKey, 0, -maxRecentTasks-1)
+		if task.TestsLocation.ObjectName != "" {
+			pipe.SAdd(ctx, testsLocationKey(task.TestsLocation), task.ID)
+		}
+		return nil
+	})
+	return err
+}
+
+func (s *RedisStore) Get(ctx context.Context, id string) (model.Task, error) {
+	data, err := s.client.Get(ctx, taskKey(id)).Bytes()
+	if errors.Is(err, redis.Nil) {
+		return model.Task{}, ErrNotFound
+	}
+	if err != nil {
+		return model.Task{}, err
+	}
+
+	var task model.Task
+	err = json.Unmarshal(data, &task)
+	return task, err
+}
+
+func (s *RedisStore) List(ctx context.Context, limit int) ([]model.Task, error) {
+	ids, err := s.client.ZRevRange(ctx, recentTasksKey, 0, int64(limit)-1).Result()
+	if err != nil {
+		return nil, err
+	}
+	return s.getMany(ctx, ids)
+}
+
+func (s *RedisStore) ListByTestsLocation(ctx context.Context, location model.FileLocation) ([]model.Task, error) {
+	ids, err := s.client.SMembers(ctx, testsLocationKey(location)).Result()
+	if err != nil {
+		return nil, err
+	}
+	return s.getMany(ctx, ids)
+}
+
+func (s *RedisStore) getMany(ctx context.Context, ids []string) ([]model.Task, error) {
+	if len(ids) == 0 {
+		return []model.Task{}, nil
+	}
+
+	keys := make([]string, 0, len(ids))
+	for _, id := range ids {
+		keys = append(keys, taskKey(id))
+	}
+
+	values, err := s.client.MGet(ctx, keys...).Result()
+	if err != nil {
+		return nil, err
+	}
+
+	tasks := make([]model.Task, 0, len(values))
+	for _, value := range values {
+		// Expired tasks stay in the indexes.
+		data, ok := value.(string)
+		if !ok {
+			continue
+		}
+
+		var task model.Task
+		if err := json.Unmarshal([]byte(data), &task); err != nil {
+			return nil, err
+		}
+		tasks = append(tasks, task)
+	}
+
+	return tasks, nil
+}